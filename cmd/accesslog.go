@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+// accessLogFlags are the access log flags, only the ones set explicitly
+// override the config
+var accessLogFlags proxy.AccessLogConfig
+
+// accessLog is closed on shutdown, nil when there is no access log
+var accessLog *proxy.AccessLog
+
+func addAccessLogFlags(c *cobra.Command) {
+	def := proxy.DefaultConfig().AccessLog
+	c.Flags().StringVarP(&accessLogFlags.File, "access-log", "", def.File, "Specify the access log file, - for stdout, empty to disable.")
+	c.Flags().StringVarP(&accessLogFlags.Format, "access-log-format", "", def.Format, "Specify the access log format: common, combined, json or logfmt.")
+	c.Flags().IntVarP(&accessLogFlags.MaxSize, "access-log-max-size", "", def.MaxSize, "Specify the size in megabytes which rotates the access log.")
+	c.Flags().IntVarP(&accessLogFlags.MaxBackups, "access-log-max-backups", "", def.MaxBackups, "Specify how many rotated access logs to keep, 0 keeps them all.")
+	c.Flags().IntVarP(&accessLogFlags.MaxAge, "access-log-max-age", "", def.MaxAge, "Specify how many days to keep the rotated access logs, 0 keeps them all.")
+	c.Flags().BoolVarP(&accessLogFlags.Compress, "access-log-compress", "", def.Compress, "Compress the rotated access logs.")
+}
+
+func applyAccessLogFlags(c *cobra.Command, l *proxy.AccessLogConfig) {
+	flags := c.Flags()
+	if flags.Changed("access-log") {
+		l.File = accessLogFlags.File
+	}
+	if flags.Changed("access-log-format") {
+		l.Format = accessLogFlags.Format
+	}
+	if flags.Changed("access-log-max-size") {
+		l.MaxSize = accessLogFlags.MaxSize
+	}
+	if flags.Changed("access-log-max-backups") {
+		l.MaxBackups = accessLogFlags.MaxBackups
+	}
+	if flags.Changed("access-log-max-age") {
+		l.MaxAge = accessLogFlags.MaxAge
+	}
+	if flags.Changed("access-log-compress") {
+		l.Compress = accessLogFlags.Compress
+	}
+}
+
+// applyAccessLog opens the access log if a file is given
+func applyAccessLog(p *proxy.ProxyServer, cfg *proxy.AccessLogConfig) error {
+	if cfg.File == "" {
+		return nil
+	}
+	l, err := proxy.NewAccessLog(cfg)
+	if err != nil {
+		return err
+	}
+	accessLog = l
+	p.SetAccessLog(l)
+	return nil
+}
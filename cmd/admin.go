@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"net/http"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"go.uber.org/zap"
+)
+
+var adminAddr string
+
+// serveAdmin starts the admin API on its own listener, if an address is given
+func serveAdmin(p *proxy.ProxyServer, addr string) *http.Server {
+	if addr == "" {
+		return nil
+	}
+	srv := &http.Server{Addr: addr, Handler: p.AdminHandler()}
+	go func() {
+		zap.S().Infof("Admin server is hosting on %v", addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			zap.S().Errorf("admin server stopped: %v", err)
+		}
+	}()
+	return srv
+}
@@ -1,12 +1,10 @@
 package cmd
 
 import (
-	"fmt"
-	"net/http"
+	"time"
 	"xiaolongbaoproxy/pkg/proxy"
 
 	"github.com/spf13/cobra"
-	"go.uber.org/zap"
 )
 
 var basicCmd = &cobra.Command{
@@ -16,19 +14,27 @@ var basicCmd = &cobra.Command{
 }
 
 var (
-	host string
-	port int
+	host            string
+	port            int
+	shutdownTimeout time.Duration
 )
 
 func init() {
-	basicCmd.Flags().StringVarP(&host, "server", "s", "0.0.0.0", "Specify the host server address.")
-	basicCmd.Flags().IntVarP(&port, "port", "p", 8080, "Specify the port number.")
+	addListenFlags(basicCmd)
+	addTracingFlags(basicCmd)
+	addAccessLogFlags(basicCmd)
 }
 
-func runProxy(cmd *cobra.Command, args []string) {
-	addr := fmt.Sprintf("%v:%v", host, port)
-	zap.S().Infof("Proxy server is hosting on %v", addr)
+// addListenFlags are the flags of every proxy command
+func addListenFlags(c *cobra.Command) {
+	c.Flags().StringVarP(&host, "server", "s", "0.0.0.0", "Specify the host server address.")
+	c.Flags().IntVarP(&port, "port", "p", 8080, "Specify the port number.")
+	c.Flags().StringVarP(&adminAddr, "admin", "", "", "Specify the address of the admin API, empty to disable.")
+	c.Flags().DurationVarP(&shutdownTimeout, "shutdown-timeout", "", proxy.SHUTDOWNTIMEOUT, "Specify how long the tunnels are drained on SIGINT or SIGTERM before they are closed.")
+}
 
-	p := proxy.NewProxyServer(nil)
-	http.ListenAndServe(addr, p)
+func runProxy(cmd *cobra.Command, args []string) {
+	serve(cmd, func(cfg *proxy.Config) {
+		cfg.Mode = proxy.MODEBASIC
+	})
 }
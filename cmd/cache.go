@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"xiaolongbaoproxy/pkg/key"
+	"xiaolongbaoproxy/pkg/keycache"
+
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the certificate cache store",
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the cached certificates",
+	Args:  cobra.NoArgs,
+	RunE:  runCacheList,
+}
+
+var cacheShowCmd = &cobra.Command{
+	Use:   "show <host>",
+	Short: "Show the cached certificate of a host",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runCacheShow,
+}
+
+var cachePurgeCmd = &cobra.Command{
+	Use:   "purge <host>|--expired|--all",
+	Short: "Remove the certificate of a host, the expired ones, or all of them",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runCachePurge,
+}
+
+var cachePrewarmCmd = &cobra.Command{
+	Use:   "prewarm <hostlist>",
+	Short: "Issue certificates for the hosts in a file (one per line, - for stdin)",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runCachePrewarm,
+}
+
+var (
+	purgeExpired bool
+	purgeAll     bool
+)
+
+func init() {
+	addCAFlags(cacheCmd.PersistentFlags())
+	cachePurgeCmd.Flags().BoolVarP(&purgeExpired, "expired", "", false, "Only remove the expired certificates.")
+	cachePurgeCmd.Flags().BoolVarP(&purgeAll, "all", "", false, "Remove all the certificates.")
+
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheShowCmd)
+	cacheCmd.AddCommand(cachePurgeCmd)
+	cacheCmd.AddCommand(cachePrewarmCmd)
+}
+
+func openCertCache() (keycache.CertCache, *key.Certificate, error) {
+	cert, err := key.LoadCertificateFromFile(conf.CA.Cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read cert failed: %v", err)
+	}
+	cache, err := keycache.NewCertCache(conf.Cache.Store, cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open cert cache failed: %v", err)
+	}
+	return cache, cert, nil
+}
+
+func entryStatus(e *keycache.Entry, ca *key.Certificate) string {
+	switch {
+	case e.Cert == nil:
+		return "broken"
+	case e.Expired():
+		return "expired"
+	case e.CAFingerprint != ca.Fingerprint():
+		return "other-ca"
+	case e.Cert.NotAfter.Before(time.Now().Add(keycache.RENEWBEFORE)):
+		return "renewing"
+	default:
+		return "valid"
+	}
+}
+
+func shortFingerprint(fp string) string {
+	if len(fp) > 16 {
+		return fp[:16]
+	}
+	if fp == "" {
+		return "-"
+	}
+	return fp
+}
+
+func runCacheList(cmd *cobra.Command, args []string) error {
+	cache, ca, err := openCertCache()
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+
+	entries, err := cache.List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tISSUED\tEXPIRES\tCA\tSTATUS")
+	for _, e := range entries {
+		issued, expires := "-", "-"
+		if e.Cert != nil {
+			issued = e.Cert.NotBefore.Local().Format(time.RFC3339)
+			expires = e.Cert.NotAfter.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", e.Host, issued, expires, shortFingerprint(e.CAFingerprint), entryStatus(e, ca))
+	}
+	return tw.Flush()
+}
+
+func runCacheShow(cmd *cobra.Command, args []string) error {
+	cache, ca, err := openCertCache()
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+
+	entries, err := cache.List()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Host != args[0] {
+			continue
+		}
+		fmt.Printf("Host:           %v\n", e.Host)
+		fmt.Printf("Status:         %v\n", entryStatus(e, ca))
+		fmt.Printf("CA fingerprint: %v\n", e.CAFingerprint)
+		if e.Cert != nil {
+			fmt.Printf("Subject:        %v\n", e.Cert.Subject)
+			fmt.Printf("Issuer:         %v\n", e.Cert.Issuer)
+			fmt.Printf("Serial:         %v\n", e.Cert.SerialNumber)
+			fmt.Printf("Issued:         %v\n", e.Cert.NotBefore.Local().Format(time.RFC3339))
+			fmt.Printf("Expires:        %v\n", e.Cert.NotAfter.Local().Format(time.RFC3339))
+			fmt.Printf("DNS names:      %v\n", strings.Join(e.Cert.DNSNames, ", "))
+			fmt.Printf("IP addresses:   %v\n", e.Cert.IPAddresses)
+		}
+		return nil
+	}
+	return fmt.Errorf("no cached certificate for %v", args[0])
+}
+
+func runCachePurge(cmd *cobra.Command, args []string) error {
+	// nothing is removed unless asked for explicitly
+	given := len(args)
+	for _, flag := range []bool{purgeExpired, purgeAll} {
+		if flag {
+			given++
+		}
+	}
+	if given != 1 {
+		return fmt.Errorf("specify one of a host, --expired or --all")
+	}
+
+	cache, _, err := openCertCache()
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+
+	switch {
+	case len(args) == 1:
+		if err := cache.Delete(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("removed %v\n", args[0])
+	case purgeExpired:
+		n, err := keycache.PurgeExpired(cache)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %v expired certificates\n", n)
+	default:
+		entries, err := cache.List()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := cache.Delete(e.Host); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("removed %v certificates\n", len(entries))
+	}
+	return nil
+}
+
+func readHostList(r io.Reader) ([]string, error) {
+	var hosts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, scanner.Err()
+}
+
+func runCachePrewarm(cmd *cobra.Command, args []string) error {
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	hosts, err := readHostList(in)
+	if err != nil {
+		return err
+	}
+
+	pk, err := key.LoadPKFromFile(conf.CA.Key)
+	if err != nil {
+		return fmt.Errorf("read key failed: %v", err)
+	}
+	cache, ca, err := openCertCache()
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+	// leaves signed by a key of another CA would be cached as valid
+	if err := key.ValidateCA(ca, pk); err != nil {
+		return fmt.Errorf("invalid CA: %v", err)
+	}
+
+	for _, host := range hosts {
+		if _, err := cache.GetKeyPair(host); err == nil {
+			fmt.Printf("%v: cached\n", host)
+			continue
+		}
+		leaf, err := key.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		if _, err := keycache.IssueKeyPair(cache, host, leaf, pk, ca); err != nil {
+			return fmt.Errorf("issue certificate for %v failed: %v", host, err)
+		}
+		fmt.Printf("%v: issued\n", host)
+	}
+	return nil
+}
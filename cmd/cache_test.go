@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"xiaolongbaoproxy/pkg/key"
+	"xiaolongbaoproxy/pkg/keycache"
+)
+
+// testCA is a throwaway CA written into a temp directory, with the
+// cert cache next to it
+type testCA struct {
+	dir    string
+	cert   *key.Certificate
+	pk     *key.PrivateKey
+	rsaKey *rsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "xiaolongbao test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{dir: dir, rsaKey: rsaKey}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_CERTIFICATE, Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_PRIVATE_KEY, Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := ioutil.WriteFile(ca.certPath(), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ca.keyPath(), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = key.LoadCertificateFromFile(ca.certPath()); err != nil {
+		t.Fatal(err)
+	}
+	if ca.pk, err = key.LoadPKFromFile(ca.keyPath()); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func (ca *testCA) certPath() string { return filepath.Join(ca.dir, "root.crt") }
+
+func (ca *testCA) keyPath() string { return filepath.Join(ca.dir, "root.key") }
+
+func (ca *testCA) store() string { return keycache.DIRSCHEME + filepath.Join(ca.dir, "certs") }
+
+// addLeaf stores a leaf for host which expires at notAfter
+func (ca *testCA) addLeaf(t *testing.T, host string, notAfter time.Time) {
+	t.Helper()
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert.Cert, &leafKey.PublicKey, ca.rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := keycache.NewCertCache(ca.store(), ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_PRIVATE_KEY, Bytes: x509.MarshalPKCS1PrivateKey(leafKey)})
+	if err := cache.SetKeyPair(host, der, keyPem); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ca *testCA) hosts(t *testing.T) []string {
+	t.Helper()
+	cache, err := keycache.NewCertCache(ca.store(), ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	entries, err := cache.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []string{}
+	for _, e := range entries {
+		hosts = append(hosts, e.Host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// runCache runs the cache subcommand with the CA and store of ca
+func runCache(ca *testCA, args ...string) error {
+	purgeExpired, purgeAll = false, false
+	rootCmd.SetArgs(append(append([]string{"cache"}, args...),
+		"--certpath", ca.certPath(), "--keypath", ca.keyPath(), "--certcache", ca.store()))
+	return rootCmd.Execute()
+}
+
+func TestReadHostList(t *testing.T) {
+	hosts, err := readHostList(strings.NewReader("a.com\n\n  # comment\n b.com \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(hosts, ",") != "a.com,b.com" {
+		t.Fatalf("hosts = %v", hosts)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		left    string
+	}{
+		{"one host", []string{"valid.com"}, false, "expired.com,renewing.com"},
+		{"expired", []string{"--expired"}, false, "renewing.com,valid.com"},
+		{"all", []string{"--all"}, false, ""},
+		{"nothing", nil, true, "expired.com,renewing.com,valid.com"},
+		{"host and expired", []string{"valid.com", "--expired"}, true, "expired.com,renewing.com,valid.com"},
+		{"expired and all", []string{"--expired", "--all"}, true, "expired.com,renewing.com,valid.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := newTestCA(t)
+			defer os.RemoveAll(ca.dir)
+			ca.addLeaf(t, "expired.com", time.Now().Add(-time.Hour))
+			ca.addLeaf(t, "renewing.com", time.Now().Add(keycache.RENEWBEFORE/2))
+			ca.addLeaf(t, "valid.com", time.Now().Add(30*24*time.Hour))
+
+			err := runCache(ca, append([]string{"purge"}, tt.args...)...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if left := strings.Join(ca.hosts(t), ","); left != tt.left {
+				t.Fatalf("left %q, want %q", left, tt.left)
+			}
+		})
+	}
+}
+
+func TestCachePrewarm(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.RemoveAll(ca.dir)
+	hostlist := filepath.Join(ca.dir, "hosts.txt")
+	if err := ioutil.WriteFile(hostlist, []byte("a.com\n# skipped\nb.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := runCache(ca, "prewarm", hostlist); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hosts := strings.Join(ca.hosts(t), ","); hosts != "a.com,b.com" {
+		t.Fatalf("cached %v", hosts)
+	}
+	if err := runCache(ca, "list"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCache(ca, "show", "a.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCache(ca, "show", "c.com"); err == nil {
+		t.Fatal("show found an uncached host")
+	}
+}
+
+func TestCachePrewarmRejectsAMismatchedCA(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.RemoveAll(ca.dir)
+	other := newTestCA(t)
+	defer os.RemoveAll(other.dir)
+	otherKey, err := ioutil.ReadFile(other.keyPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ca.keyPath(), otherKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostlist := filepath.Join(ca.dir, "hosts.txt")
+	if err := ioutil.WriteFile(hostlist, []byte("a.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCache(ca, "prewarm", hostlist); err == nil || !strings.Contains(err.Error(), "invalid CA") {
+		t.Fatalf("err = %v, want an invalid CA", err)
+	}
+	if hosts := ca.hosts(t); len(hosts) != 0 {
+		t.Fatalf("cached %v with a mismatched CA", hosts)
+	}
+}
+
+func TestEntryStatus(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.RemoveAll(ca.dir)
+	other := newTestCA(t)
+	defer os.RemoveAll(other.dir)
+	now := time.Now()
+	tests := []struct {
+		entry *keycache.Entry
+		want  string
+	}{
+		{&keycache.Entry{}, "broken"},
+		{&keycache.Entry{Cert: &x509.Certificate{NotAfter: now.Add(-time.Hour)}, CAFingerprint: ca.cert.Fingerprint()}, "expired"},
+		{&keycache.Entry{Cert: &x509.Certificate{NotAfter: now.Add(48 * time.Hour)}, CAFingerprint: other.cert.Fingerprint()}, "other-ca"},
+		{&keycache.Entry{Cert: &x509.Certificate{NotAfter: now.Add(time.Hour)}, CAFingerprint: ca.cert.Fingerprint()}, "renewing"},
+		{&keycache.Entry{Cert: &x509.Certificate{NotAfter: now.Add(48 * time.Hour)}, CAFingerprint: ca.cert.Fingerprint()}, "valid"},
+	}
+	for _, tt := range tests {
+		if got := entryStatus(tt.entry, ca.cert); got != tt.want {
+			t.Errorf("status = %v, want %v", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// CONFIGENVPREFIX prefixes the environment variables overriding the config
+// file, e.g. XIAOLONGBAO_CA_CERT or XIAOLONGBAO_LOG_LEVEL
+const CONFIGENVPREFIX = "XIAOLONGBAO"
+
+var configFile string
+
+// fileConfig is the content of the config file, the proxy part and the
+// diagnostic log
+type fileConfig struct {
+	proxy.Config `yaml:",inline"`
+	Log          logConfig `json:"log" yaml:"log"`
+}
+
+// conf is loaded before any command runs, from the defaults, the config
+// file, the environment and the flags set explicitly, in this order
+var conf *fileConfig
+
+func defaultFileConfig() *fileConfig {
+	return &fileConfig{
+		Config: *proxy.DefaultConfig(),
+		Log:    defaultLogConfig(),
+	}
+}
+
+func addConfigFlags(c *cobra.Command) {
+	c.PersistentFlags().StringVarP(&configFile, "config", "", "", "Specify a yaml, toml or json config file, the environment and the flags override it. Defaults to $"+CONFIGENVPREFIX+"_CONFIG.")
+}
+
+// configFilename is the config file given by the flag or the environment
+func configFilename() string {
+	if configFile != "" {
+		return configFile
+	}
+	return os.Getenv(CONFIGENVPREFIX + "_CONFIG")
+}
+
+func loadConfig(c *cobra.Command) (*fileConfig, error) {
+	cfg := defaultFileConfig()
+	if filename := configFilename(); filename != "" {
+		if err := readConfigFile(filename, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(CONFIGENVPREFIX, reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	if err := applyFlags(c, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfigFile decodes the file over cfg by its extension, the keys it
+// does not know are errors
+func readConfigFile(filename string, cfg *fileConfig) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, cfg)
+	case ".json":
+		err = decodeJsonStrict(data, cfg)
+	case ".toml":
+		// toml goes through json, so the json names are the only ones
+		var m map[string]interface{}
+		if _, err = toml.Decode(string(data), &m); err == nil {
+			if data, err = json.Marshal(m); err == nil {
+				err = decodeJsonStrict(data, cfg)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown config format %v, expect .yaml, .toml or .json", filename)
+	}
+	if err != nil {
+		return fmt.Errorf("parse config %v failed: %v", filename, err)
+	}
+	return nil
+}
+
+func decodeJsonStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// applyEnv sets the fields of v from PREFIX_<JSON_NAME> variables, nested
+// structs add their name to the prefix. Lists are comma separated, maps are
+// k=v lists, the other composite fields are left to the file.
+func applyEnv(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if field.Anonymous {
+			if err := applyEnv(prefix, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		env := prefix + "_" + strings.ToUpper(name)
+
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(env, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, s); err != nil {
+			return fmt.Errorf("invalid %v: %v", env, err)
+		}
+	}
+	return nil
+}
+
+func setFromEnv(fv reflect.Value, s string) error {
+	if u, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("only settable in the config file")
+		}
+		fv.Set(reflect.ValueOf(splitList(s)))
+	case reflect.Map:
+		if fv.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("only settable in the config file")
+		}
+		m := make(map[string]string)
+		for _, kv := range splitList(s) {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("expect k=v: %v", kv)
+			}
+			m[parts[0]] = parts[1]
+		}
+		fv.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("only settable in the config file")
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			l = append(l, item)
+		}
+	}
+	return l
+}
+
+// applyFlags overrides the config with the flags set on the command line,
+// the flags the command does not have are never set
+func applyFlags(c *cobra.Command, cfg *fileConfig) error {
+	flags := c.Flags()
+	if flags.Changed("server") || flags.Changed("port") {
+		h := host
+		if !flags.Changed("server") && len(cfg.Listen) > 0 {
+			// only the port is given, keep the host of the config
+			h, _, _ = net.SplitHostPort(cfg.Listen[0])
+		}
+		cfg.Listen = []string{net.JoinHostPort(h, strconv.Itoa(port))}
+	}
+	if flags.Changed("admin") {
+		cfg.Admin = adminAddr
+	}
+	if flags.Changed("shutdown-timeout") {
+		cfg.ShutdownTimeout = proxy.Duration(shutdownTimeout)
+	}
+	if flags.Changed("certpath") {
+		cfg.CA.Cert = certpath
+	}
+	if flags.Changed("keypath") {
+		cfg.CA.Key = keypath
+	}
+	if flags.Changed("certcache") {
+		cfg.Cache.Store = certcache
+	}
+	if flags.Changed("keypool") {
+		cfg.Cache.KeyPool = keypool
+	}
+	applyLogFlags(c, &cfg.Log)
+	applyAccessLogFlags(c, &cfg.AccessLog)
+	applyTracingFlags(c, &cfg.Tracing)
+	if err := applyTlsPolicyFlags(c, &cfg.Tls); err != nil {
+		return err
+	}
+	if err := applyUpstreamTlsFlags(c, &cfg.Upstream); err != nil {
+		return err
+	}
+	return applyMitmRulesFlags(c, &cfg.Config)
+}
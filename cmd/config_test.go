@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"xiaolongbaoproxy/pkg/proxy"
+)
+
+// writeConfig writes content into a temp file called name
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// setEnv sets the environment variables for the duration of the test
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	t.Cleanup(func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"proxy.yaml", `
+listen: ["127.0.0.1:3128"]
+admin: 127.0.0.1:9090
+ca:
+  cert: ca.crt
+cache:
+  key_pool: 8
+auto_tunnel:
+  ttl: 90s
+log:
+  level: info
+  levels:
+    tls: debug
+`},
+		{"proxy.toml", `
+listen = ["127.0.0.1:3128"]
+admin = "127.0.0.1:9090"
+[ca]
+cert = "ca.crt"
+[cache]
+key_pool = 8
+[auto_tunnel]
+ttl = "90s"
+[log]
+level = "info"
+[log.levels]
+tls = "debug"
+`},
+		{"proxy.json", `{
+  "listen": ["127.0.0.1:3128"], "admin": "127.0.0.1:9090",
+  "ca": {"cert": "ca.crt"}, "cache": {"key_pool": 8},
+  "auto_tunnel": {"ttl": "90s"},
+  "log": {"level": "info", "levels": {"tls": "debug"}}
+}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultFileConfig()
+			if err := readConfigFile(writeConfig(t, tt.name, tt.content), cfg); err != nil {
+				t.Fatal(err)
+			}
+			want := defaultFileConfig()
+			want.Listen = []string{"127.0.0.1:3128"}
+			want.Admin = "127.0.0.1:9090"
+			want.CA.Cert = "ca.crt"
+			want.Cache.KeyPool = 8
+			want.AutoTunnel.TTL = proxy.Duration(90 * time.Second)
+			want.Log.Level = "info"
+			want.Log.Levels = map[string]string{"tls": "debug"}
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("got %v %+v\nwant %v %+v", cfg.Config.String(), cfg.Log, want.Config.String(), want.Log)
+			}
+		})
+	}
+}
+
+func TestReadConfigFileIsStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"proxy.yaml", "ca:\n  certificate: ca.crt\n", "certificate"},
+		{"proxy.toml", "[ca]\ncertificate = \"ca.crt\"\n", "certificate"},
+		{"proxy.json", `{"ca": {"certificate": "ca.crt"}}`, "certificate"},
+		{"proxy.yaml", "cache:\n  key_pool: many\n", "many"},
+		{"proxy.ini", "listen=:8080", "unknown config format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := readConfigFile(writeConfig(t, tt.name, tt.content), defaultFileConfig())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error about %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	setEnv(t, map[string]string{
+		"XIAOLONGBAO_LISTEN":          "127.0.0.1:1, 127.0.0.1:2",
+		"XIAOLONGBAO_CA_CERT":         "env.crt",
+		"XIAOLONGBAO_CACHE_KEY_POOL":  "4",
+		"XIAOLONGBAO_AUTO_TUNNEL_TTL": "2m",
+		"XIAOLONGBAO_TRACING_RATIO":   "0.5",
+		"XIAOLONGBAO_HOOKS_RECORD":    "true",
+		"XIAOLONGBAO_LOG_LEVELS":      "tls=debug,keycache=warn",
+	})
+	cfg := defaultFileConfig()
+	if err := applyEnv(CONFIGENVPREFIX, reflect.ValueOf(cfg).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Listen, []string{"127.0.0.1:1", "127.0.0.1:2"}) || cfg.CA.Cert != "env.crt" ||
+		cfg.Cache.KeyPool != 4 || cfg.AutoTunnel.TTL != proxy.Duration(2*time.Minute) ||
+		cfg.Tracing.Ratio != 0.5 || !cfg.Hooks.Record {
+		t.Errorf("env not applied: %v", cfg.Config.String())
+	}
+	if !reflect.DeepEqual(cfg.Log.Levels, map[string]string{"tls": "debug", "keycache": "warn"}) {
+		t.Errorf("log levels %v", cfg.Log.Levels)
+	}
+	// untouched
+	if cfg.CA.Key != "root.key" {
+		t.Errorf("ca.key = %v", cfg.CA.Key)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		env   string
+		value string
+	}{
+		{"XIAOLONGBAO_CACHE_KEY_POOL", "many"},
+		{"XIAOLONGBAO_AUTO_TUNNEL_TTL", "soon"},
+		{"XIAOLONGBAO_LOG_LEVELS", "tls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			setEnv(t, map[string]string{tt.env: tt.value})
+			err := applyEnv(CONFIGENVPREFIX, reflect.ValueOf(defaultFileConfig()).Elem())
+			if err == nil || !strings.HasPrefix(err.Error(), "invalid "+tt.env) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	filename := writeConfig(t, "proxy.yaml", "admin: 127.0.0.1:1000\nca:\n  cert: file.crt\n  key: file.key\n")
+	setEnv(t, map[string]string{"XIAOLONGBAO_CONFIG": filename, "XIAOLONGBAO_CA_KEY": "env.key"})
+	defer func() { configFile = "" }()
+	if err := serveCmd.ParseFlags([]string{"--admin", "127.0.0.1:2000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(serveCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the flag over the file, the env over the file, the file over the default
+	if cfg.Admin != "127.0.0.1:2000" || cfg.CA.Key != "env.key" || cfg.CA.Cert != "file.crt" || cfg.Cache.Store != "certstore.db" {
+		t.Errorf("got %v", cfg.Config.String())
+	}
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"xiaolongbaoproxy/pkg/keycache"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logConfig describes the diagnostic log, the access log is apart
+type logConfig struct {
+	// Level is debug, info, warn or error
+	Level string `json:"level" yaml:"level"`
+	// Encoding is console or json
+	Encoding string `json:"encoding" yaml:"encoding"`
+	// Outputs are files, stdout or stderr
+	Outputs []string `json:"outputs" yaml:"outputs"`
+	// SamplingInitial and SamplingThereafter keep the first entries with the
+	// same message in each second, then every Thereafter-th. 0 disables it.
+	SamplingInitial    int `json:"sampling_initial" yaml:"sampling_initial"`
+	SamplingThereafter int `json:"sampling_thereafter" yaml:"sampling_thereafter"`
+	// Levels overrides Level for the proxy, tls and keycache loggers
+	Levels map[string]string `json:"levels" yaml:"levels"`
+}
+
+// logFlags are the log flags, only the ones set explicitly override the config
+var logFlags logConfig
+
+// the loggers which can have their own level
+var subsystems = []string{proxy.LOGGERPROXY, proxy.LOGGERTLS, keycache.LOGGERNAME}
+
+func defaultLogConfig() logConfig {
+	return logConfig{
+		Level:              "debug",
+		Encoding:           "console",
+		Outputs:            []string{"stderr"},
+		SamplingThereafter: 100,
+	}
+}
+
+func addLogFlags(c *cobra.Command) {
+	def := defaultLogConfig()
+	c.PersistentFlags().StringVarP(&logFlags.Level, "log-level", "", def.Level, "Specify the log level: debug, info, warn or error.")
+	c.PersistentFlags().StringVarP(&logFlags.Encoding, "log-encoding", "", def.Encoding, "Specify the log encoding: console or json.")
+	c.PersistentFlags().StringSliceVarP(&logFlags.Outputs, "log-output", "", def.Outputs, "Specify the log outputs, files, stdout or stderr.")
+	c.PersistentFlags().IntVarP(&logFlags.SamplingInitial, "log-sampling-initial", "", def.SamplingInitial, "Specify how many entries with the same message to log each second before sampling, 0 disables sampling.")
+	c.PersistentFlags().IntVarP(&logFlags.SamplingThereafter, "log-sampling-thereafter", "", def.SamplingThereafter, "Specify to log every nth entry with the same message once sampling.")
+	c.PersistentFlags().StringToStringVarP(&logFlags.Levels, "log-levels", "", nil,
+		fmt.Sprintf("Specify the levels of the subsystems, e.g. tls=debug,keycache=warn. The subsystems are %v.", strings.Join(subsystems, ", ")))
+}
+
+func applyLogFlags(c *cobra.Command, l *logConfig) {
+	flags := c.Flags()
+	if flags.Changed("log-level") {
+		l.Level = logFlags.Level
+	}
+	if flags.Changed("log-encoding") {
+		l.Encoding = logFlags.Encoding
+	}
+	if flags.Changed("log-output") {
+		l.Outputs = logFlags.Outputs
+	}
+	if flags.Changed("log-sampling-initial") {
+		l.SamplingInitial = logFlags.SamplingInitial
+	}
+	if flags.Changed("log-sampling-thereafter") {
+		l.SamplingThereafter = logFlags.SamplingThereafter
+	}
+	if flags.Changed("log-levels") {
+		if l.Levels == nil {
+			l.Levels = make(map[string]string)
+		}
+		for name, level := range logFlags.Levels {
+			l.Levels[name] = level
+		}
+	}
+}
+
+// closeLogOutputs closes the outputs of the global logger
+var closeLogOutputs func()
+
+// applyLogging replaces the global logger
+func applyLogging(l *logConfig) error {
+	logger, closeOutputs, err := newLogger(l)
+	if err != nil {
+		return err
+	}
+	replaceLogger(logger, closeOutputs)
+	return nil
+}
+
+// replaceLogger makes logger the global one, the previous one is flushed
+// and its outputs are closed
+func replaceLogger(logger *zap.Logger, closeOutputs func()) {
+	old, closeOld := zap.L(), closeLogOutputs
+	zap.ReplaceGlobals(logger)
+	closeLogOutputs = closeOutputs
+	old.Sync()
+	if closeOld != nil {
+		closeOld()
+	}
+}
+
+// newLogger builds the logger described by c, and the function closing its
+// outputs
+func newLogger(c *logConfig) (*zap.Logger, func(), error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level: %v", c.Level)
+	}
+	levels := make(map[string]zapcore.Level)
+	for name, l := range c.Levels {
+		if !isSubsystem(name) {
+			return nil, nil, fmt.Errorf("unknown log subsystem: %v", name)
+		}
+		var sl zapcore.Level
+		if err := sl.UnmarshalText([]byte(l)); err != nil {
+			return nil, nil, fmt.Errorf("invalid log level of %v: %v", name, l)
+		}
+		levels[name] = sl
+	}
+
+	// the core lets through the lowest level, the subsystem levels are
+	// checked on top of it
+	min := level
+	for _, l := range levels {
+		if l < min {
+			min = l
+		}
+	}
+
+	var encoder zapcore.Encoder
+	switch c.Encoding {
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	case "json":
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	default:
+		return nil, nil, fmt.Errorf("invalid log encoding: %v", c.Encoding)
+	}
+	// zap.Config.Build would lose the function closing the files
+	output, closeOutputs, err := zap.Open(c.Outputs...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	core := zapcore.NewCore(encoder, output, zap.NewAtomicLevelAt(min))
+	if c.SamplingInitial > 0 {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, c.SamplingInitial, c.SamplingThereafter)
+	}
+	core = &subsystemCore{Core: core, level: level, levels: levels}
+	return zap.New(core, zap.ErrorOutput(zapcore.Lock(os.Stderr)), zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)), closeOutputs, nil
+}
+
+func isSubsystem(name string) bool {
+	for _, s := range subsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// subsystemCore filters the entries by the level of their logger
+type subsystemCore struct {
+	zapcore.Core
+	level  zapcore.Level
+	levels map[string]zapcore.Level
+}
+
+func (c *subsystemCore) With(fields []zapcore.Field) zapcore.Core {
+	return &subsystemCore{Core: c.Core.With(fields), level: c.level, levels: c.levels}
+}
+
+func (c *subsystemCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	level := c.level
+	name := strings.SplitN(ent.LoggerName, ".", 2)[0]
+	if l, ok := c.levels[name]; ok {
+		level = l
+	}
+	if ent.Level < level {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xiaolongbaoproxy/pkg/keycache"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"go.uber.org/zap"
+)
+
+func TestNewLoggerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		conf logConfig
+		err  string
+	}{
+		{"level", logConfig{Level: "verbose", Encoding: "json"}, "invalid log level: verbose"},
+		{"encoding", logConfig{Level: "info", Encoding: "xml"}, "invalid log encoding: xml"},
+		{"subsystem", logConfig{Level: "info", Encoding: "json", Levels: map[string]string{"http": "debug"}}, "unknown log subsystem: http"},
+		{"subsystem level", logConfig{Level: "info", Encoding: "json", Levels: map[string]string{"tls": "loud"}}, "invalid log level of tls: loud"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := newLogger(&tt.conf); err == nil || err.Error() != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xiaolongbao")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "proxy.log")
+
+	logger, closeOutputs, err := newLogger(&logConfig{
+		Level:    "info",
+		Encoding: "json",
+		Outputs:  []string{out},
+		Levels:   map[string]string{proxy.LOGGERTLS: "debug", keycache.LOGGERNAME: "error"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeOutputs()
+	s := logger.Sugar()
+	s.Debug("root debug")
+	s.Info("root info")
+	s.Named(proxy.LOGGERPROXY).Debug("proxy debug")
+	s.Named(proxy.LOGGERPROXY).Info("proxy info")
+	s.Named(proxy.LOGGERTLS).Debug("tls debug")
+	s.Named(proxy.LOGGERTLS).Named("upstream").Debug("tls child debug")
+	s.Named(keycache.LOGGERNAME).Warn("keycache warn")
+	s.Named(keycache.LOGGERNAME).Error("keycache error")
+	logger.Sync()
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := string(data)
+	for msg, want := range map[string]bool{
+		"root debug":      false,
+		"root info":       true,
+		"proxy debug":     false,
+		"proxy info":      true,
+		"tls debug":       true,
+		"tls child debug": true,
+		"keycache warn":   false,
+		"keycache error":  true,
+	} {
+		if got := strings.Contains(logged, `"`+msg+`"`); got != want {
+			t.Errorf("%q logged %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestReplaceLoggerClosesTheOldOutputs(t *testing.T) {
+	previous, closePrevious := zap.L(), closeLogOutputs
+	defer func() {
+		zap.ReplaceGlobals(previous)
+		closeLogOutputs = closePrevious
+	}()
+	closeLogOutputs = nil
+
+	closed := make(map[string]int)
+	replaceLogger(zap.NewNop(), func() { closed["first"]++ })
+	if len(closed) != 0 {
+		t.Fatalf("closed %v before a replacement", closed)
+	}
+	second := zap.NewNop()
+	replaceLogger(second, func() { closed["second"]++ })
+	if closed["first"] != 1 || closed["second"] != 0 {
+		t.Errorf("closed %v, want only the first outputs", closed)
+	}
+	if zap.L() != second {
+		t.Error("the global logger was not replaced")
+	}
+}
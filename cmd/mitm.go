@@ -1,12 +1,10 @@
 package cmd
 
 import (
-	"fmt"
-	"net/http"
 	"xiaolongbaoproxy/pkg/proxy"
 
 	"github.com/spf13/cobra"
-	"go.uber.org/zap"
+	"github.com/spf13/pflag"
 )
 
 var mitmCmd = &cobra.Command{
@@ -19,20 +17,36 @@ var (
 	certpath  string
 	keypath   string
 	certcache string
+	keypool   int
 )
 
 func init() {
-	mitmCmd.Flags().StringVarP(&host, "server", "s", "0.0.0.0", "Specify the host server address.")
-	mitmCmd.Flags().IntVarP(&port, "port", "p", 8080, "Specify the port number.")
-	mitmCmd.Flags().StringVarP(&certpath, "certpath", "c", "root.crt", "Specify the path for the CA certificate.")
-	mitmCmd.Flags().StringVarP(&keypath, "keypath", "k", "root.key", "Specify the path for the CA private key.")
-	mitmCmd.Flags().StringVarP(&certcache, "certcache", "", "certstore.db", "Specify the path for the certificate cache store.")
+	addListenFlags(mitmCmd)
+	addMitmFlags(mitmCmd)
+	addTracingFlags(mitmCmd)
+	addAccessLogFlags(mitmCmd)
 }
 
-func runMitmProxy(cmd *cobra.Command, args []string) {
-	addr := fmt.Sprintf("%v:%v", host, port)
-	zap.S().Infof("Proxy server is hosting on %v", addr)
+// addCAFlags are the flags of the CA and its cert cache, shared with the
+// cache commands
+func addCAFlags(fs *pflag.FlagSet) {
+	def := proxy.DefaultConfig()
+	fs.StringVarP(&certpath, "certpath", "c", def.CA.Cert, "Specify the path for the CA certificate.")
+	fs.StringVarP(&keypath, "keypath", "k", def.CA.Key, "Specify the path for the CA private key.")
+	fs.StringVarP(&certcache, "certcache", "", def.Cache.Store, "Specify the certificate cache store: a bbolt path, bolt:///path, dir:///path or mem://.")
+}
 
-	p := proxy.NewMitmProxyServer(certpath, keypath, certcache, nil)
-	http.ListenAndServe(addr, p)
+// addMitmFlags are the flags of the commands intercepting tls
+func addMitmFlags(c *cobra.Command) {
+	addCAFlags(c.Flags())
+	c.Flags().IntVarP(&keypool, "keypool", "", 0, "Specify the number of pre-generated leaf keys, 0 to disable.")
+	addTlsPolicyFlags(c)
+	addUpstreamTlsFlags(c)
+	addMitmRulesFlags(c)
+}
+
+func runMitmProxy(cmd *cobra.Command, args []string) {
+	serve(cmd, func(cfg *proxy.Config) {
+		cfg.Mode = proxy.MODEMITM
+	})
 }
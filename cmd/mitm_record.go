@@ -1,8 +1,7 @@
 package cmd
 
 import (
-	"fmt"
-	"net/http"
+	"sync/atomic"
 	"xiaolongbaoproxy/pkg/proxy"
 
 	"github.com/spf13/cobra"
@@ -16,21 +15,71 @@ var mitmRecordCmd = &cobra.Command{
 }
 
 func init() {
-	mitmRecordCmd.Flags().StringVarP(&host, "server", "s", "0.0.0.0", "Specify the host server address.")
-	mitmRecordCmd.Flags().IntVarP(&port, "port", "p", 8080, "Specify the port number.")
-	mitmRecordCmd.Flags().StringVarP(&certpath, "certpath", "c", "root.crt", "Specify the path for the CA certificate.")
-	mitmRecordCmd.Flags().StringVarP(&keypath, "keypath", "k", "root.key", "Specify the path for the CA private key.")
-	mitmRecordCmd.Flags().StringVarP(&certcache, "certcache", "", "certstore.db", "Specify the path for the certificate cache store.")
+	addListenFlags(mitmRecordCmd)
+	addMitmFlags(mitmRecordCmd)
+	addTracingFlags(mitmRecordCmd)
+	addAccessLogFlags(mitmRecordCmd)
 }
 
 func runMitmProxyWithRecord(cmd *cobra.Command, args []string) {
-	addr := fmt.Sprintf("%v:%v", host, port)
-	zap.S().Infof("Proxy server is hosting on %v", addr)
+	serve(cmd, func(cfg *proxy.Config) {
+		cfg.Mode = proxy.MODEMITM
+		cfg.Hooks.Record = true
+	})
+}
+
+// recording is 1 when the config enables the record hooks
+var recording int32
+
+// setHooks switches the hooks to those of cfg
+func setHooks(cfg *proxy.Config) {
+	var v int32
+	if cfg.Hooks.Record {
+		v = 1
+	}
+	atomic.StoreInt32(&recording, v)
+}
 
-	p := proxy.NewMitmProxyServer(certpath, keypath, certcache, hook)
-	http.ListenAndServe(addr, p)
+func recordHook(ctx *proxy.ProxyCtx) {
+	if atomic.LoadInt32(&recording) == 1 {
+		hook(ctx)
+	}
+}
+
+func recordConnHook(conn *proxy.ProxyConn) {
+	if atomic.LoadInt32(&recording) == 1 {
+		connHook(conn)
+	}
 }
 
 func hook(ctx *proxy.ProxyCtx) {
 	zap.S().Debugf("[%v] url is %v, %v", ctx.Session, ctx.Request.Host, ctx.Request.Url)
+	zap.S().Debugf("[%v] request %v of connection %v from %v", ctx.Session, ctx.Seq, ctx.Conn.Id, ctx.Conn.ClientAddr)
+	zap.S().Debugf("[%v] timing: %v", ctx.Session, &ctx.Timing)
+	zap.S().Debugf("[%v] bytes: request %+v, response %+v", ctx.Session, ctx.Request.Bytes, ctx.Response.Bytes)
+	if ctx.Conn.ProxyUser != "" {
+		zap.S().Debugf("[%v] proxy user is %v", ctx.Session, ctx.Conn.ProxyUser)
+	}
+	if ctx.ClientTls != nil {
+		zap.S().Debugf("[%v] client tls: %v, %v, alpn %q, sni %v", ctx.Session,
+			ctx.ClientTls.Version, ctx.ClientTls.CipherSuite, ctx.ClientTls.ALPN, ctx.ClientTls.ServerName)
+	}
+	if ctx.UpstreamTls != nil {
+		zap.S().Debugf("[%v] upstream tls with %v: %v, %v, alpn %q, sni %v", ctx.Session, ctx.UpstreamAddr,
+			ctx.UpstreamTls.Version, ctx.UpstreamTls.CipherSuite, ctx.UpstreamTls.ALPN, ctx.UpstreamTls.ServerName)
+		for _, cert := range ctx.UpstreamTls.PeerCertificates {
+			zap.S().Debugf("[%v] upstream certificate: %v, issued by %v", ctx.Session, cert.Subject, cert.Issuer)
+		}
+	}
+	if ctx.Error != nil {
+		zap.S().Debugf("[%v] failed with %v in %v", ctx.Session, ctx.Error.Kind, ctx.Error.Phase)
+	}
+}
+
+func connHook(conn *proxy.ProxyConn) {
+	if conn.Target == "" {
+		zap.S().Debugf("connection %v from %v closed after %v requests, %v", conn.Id, conn.ClientAddr, conn.Requests(), conn.End.Sub(conn.Start))
+		return
+	}
+	zap.S().Debugf("connection %v to %v closed after %v requests, mitm %v, %v", conn.Id, conn.Target, conn.Requests(), conn.Mitm, conn.End.Sub(conn.Start))
 }
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// CONFIGPOLLINTERVAL is how often the config file is checked for changes
+const CONFIGPOLLINTERVAL = 2 * time.Second
+
+// confMu guards conf once the proxy is serving
+var confMu sync.Mutex
+
+// reloadConfig reloads the config on SIGHUP, and when the config file
+// changes. The tunnels already open keep the settings they started with.
+func reloadConfig(cmd *cobra.Command, p *proxy.ProxyServer, override func(cfg *proxy.Config)) {
+	// a reload at a time, the requests made meanwhile collapse into one
+	reload := make(chan struct{}, 1)
+	trigger := func() {
+		select {
+		case reload <- struct{}{}:
+		default:
+		}
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			zap.S().Infof("got SIGHUP, reloading the config")
+			trigger()
+		}
+	}()
+	if filename := configFilename(); filename != "" {
+		go watchConfig(filename, trigger)
+	}
+	go func() {
+		for range reload {
+			if err := applyReload(cmd, p, override); err != nil {
+				zap.S().Errorf("reload config failed, keep the running one: %v", err)
+			}
+		}
+	}()
+}
+
+// watchConfig polls the modification time and the size of the file, which
+// also catches the editors replacing the file rather than writing it
+func watchConfig(filename string, trigger func()) {
+	last, _ := os.Stat(filename)
+	for range time.Tick(CONFIGPOLLINTERVAL) {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			// e.g. in the middle of a rename, look again later
+			continue
+		}
+		if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+			zap.S().Infof("config %v changed, reloading it", filename)
+			trigger()
+		}
+		last = fi
+	}
+}
+
+func applyReload(cmd *cobra.Command, p *proxy.ProxyServer, override func(cfg *proxy.Config)) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	if override != nil {
+		override(&cfg.Config)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	confMu.Lock()
+	keepRestartOnly(&conf.Config, &cfg.Config)
+	logChanged := !reflect.DeepEqual(conf.Log, cfg.Log)
+	confMu.Unlock()
+	// the outputs are opened again only if needed, and closed on error
+	var logger *zap.Logger
+	var closeOutputs func()
+	if logChanged {
+		if logger, closeOutputs, err = newLogger(&cfg.Log); err != nil {
+			return err
+		}
+	}
+
+	if err := p.ApplyConfig(&cfg.Config); err != nil {
+		if closeOutputs != nil {
+			closeOutputs()
+		}
+		return err
+	}
+	setHooks(&cfg.Config)
+	if logger != nil {
+		replaceLogger(logger, closeOutputs)
+	}
+	confMu.Lock()
+	conf = cfg
+	confMu.Unlock()
+	zap.S().Infof("reloaded the config")
+	return nil
+}
+
+// keepRestartOnly keeps the running values of the settings a reload cannot
+// change, they are bound to the listeners or opened once
+func keepRestartOnly(running, cfg *proxy.Config) {
+	fields := []struct {
+		name         string
+		running, new interface{}
+	}{
+		{"listen", &running.Listen, &cfg.Listen},
+		{"mode", &running.Mode, &cfg.Mode},
+		{"admin", &running.Admin, &cfg.Admin},
+		{"cache", &running.Cache, &cfg.Cache},
+		{"access_log", &running.AccessLog, &cfg.AccessLog},
+		{"tracing", &running.Tracing, &cfg.Tracing},
+	}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.running, f.new) {
+			zap.S().Warnf("%v changed, it needs a restart to take effect", f.name)
+			reflect.ValueOf(f.new).Elem().Set(reflect.ValueOf(f.running).Elem())
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"xiaolongbaoproxy/pkg/proxy"
+)
+
+func TestKeepRestartOnly(t *testing.T) {
+	running := proxy.DefaultConfig()
+	cfg := proxy.DefaultConfig()
+	cfg.Listen = []string{"127.0.0.1:3128"}
+	cfg.Mode = proxy.MODEBASIC
+	cfg.Cache.Store = "other.db"
+	cfg.Tracing.Endpoint = "localhost:4318"
+	cfg.Rules.Tunnel = []string{"tunnel.test"}
+	cfg.Hooks.Record = true
+
+	keepRestartOnly(running, cfg)
+	want := proxy.DefaultConfig()
+	want.Rules.Tunnel = []string{"tunnel.test"}
+	want.Hooks.Record = true
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %v\nwant %v", cfg, want)
+	}
+}
+
+func TestSetHooks(t *testing.T) {
+	defer setHooks(&proxy.Config{})
+	for _, record := range []bool{true, false} {
+		setHooks(&proxy.Config{Hooks: proxy.HooksConfig{Record: record}})
+		if got := recording == 1; got != record {
+			t.Errorf("recording %v, want %v", got, record)
+		}
+	}
+}
@@ -12,22 +12,34 @@ var rootCmd = &cobra.Command{
 	Use:   "xiaolongbaoproxy",
 	Short: "Start a HTTP/S proxy",
 	Long:  "",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// the flags are parsed, a bad value is not a usage error
+		cmd.SilenceUsage = true
+		var err error
+		if conf, err = loadConfig(cmd); err != nil {
+			return err
+		}
+		return applyLogging(&conf.Log)
+	},
 }
 
 func Execute() {
+	defer zap.L().Sync()
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		zap.L().Error(err.Error())
+		zap.L().Sync()
 		os.Exit(1)
 	}
 }
 
 func init() {
-	logger, _ := zap.NewDevelopment()
-	defer logger.Sync()
-	zap.ReplaceGlobals(logger)
+	addConfigFlags(rootCmd)
+	addLogFlags(rootCmd)
+	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(basicCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(mitmCmd)
 	rootCmd.AddCommand(mitmRecordCmd)
+	rootCmd.AddCommand(cacheCmd)
 }
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"time"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	mitmRulesFile   string
+	mitmDefault     string
+	mitmHosts       []string
+	mitmTunnelHosts []string
+	autoTunnelAfter int
+	autoTunnelTTL   time.Duration
+)
+
+func addMitmRulesFlags(c *cobra.Command) {
+	c.Flags().StringVarP(&mitmRulesFile, "mitm-rules", "", "", "Specify a json file with the hosts to intercept or tunnel, it replaces the rules of the config and the flags below add to them.")
+	c.Flags().StringVarP(&mitmDefault, "mitm-default", "", "", "Specify what to do with the hosts matching no rule: mitm or tunnel.")
+	c.Flags().StringSliceVarP(&mitmHosts, "mitm-host", "", nil, "Specify the host patterns to intercept: example.com, *.example.com, re:<regexp> or a cidr.")
+	c.Flags().StringSliceVarP(&mitmTunnelHosts, "tunnel-host", "", nil, "Specify the host patterns to tunnel without interception, they win over --mitm-host.")
+	c.Flags().IntVarP(&autoTunnelAfter, "auto-tunnel-after", "", proxy.PASSTHROUGHTHRESHOLD, "Tunnel a host once clients rejected its certificate this many times, 0 to disable.")
+	c.Flags().DurationVarP(&autoTunnelTTL, "auto-tunnel-ttl", "", proxy.PASSTHROUGHTTL, "Specify how long a host stays tunnelled after its certificate was rejected.")
+}
+
+// applyMitmRulesFlags replaces the rules of the config with the rules file if
+// any, then adds the flags
+func applyMitmRulesFlags(c *cobra.Command, cfg *proxy.Config) error {
+	if mitmRulesFile != "" {
+		rules, err := proxy.LoadMitmRules(mitmRulesFile)
+		if err != nil {
+			return err
+		}
+		cfg.Rules = *rules
+	}
+
+	flags := c.Flags()
+	if flags.Changed("mitm-default") {
+		cfg.Rules.Default = mitmDefault
+	}
+	cfg.Rules.Mitm = append(cfg.Rules.Mitm, mitmHosts...)
+	cfg.Rules.Tunnel = append(cfg.Rules.Tunnel, mitmTunnelHosts...)
+	if flags.Changed("auto-tunnel-after") {
+		cfg.AutoTunnel.After = autoTunnelAfter
+	}
+	if flags.Changed("auto-tunnel-ttl") {
+		cfg.AutoTunnel.TTL = proxy.Duration(autoTunnelTTL)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Start the proxy described by the config file",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		serve(cmd, nil)
+	},
+}
+
+func init() {
+	addListenFlags(serveCmd)
+	addMitmFlags(serveCmd)
+	addTracingFlags(serveCmd)
+	addAccessLogFlags(serveCmd)
+}
+
+// serve validates the config and runs the proxy it describes until a signal
+// or a failed listener shuts it down. override forces the settings of the command, e.g.
+// its mode, over the config, again on each reload.
+func serve(cmd *cobra.Command, override func(cfg *proxy.Config)) {
+	if override != nil {
+		override(&conf.Config)
+	}
+	cfg := &conf.Config
+	if err := cfg.Validate(); err != nil {
+		zap.S().Fatalf("%v", err)
+	}
+
+	// the hooks check the config of the moment, a reload switches them
+	p, err := proxy.NewProxyServerFromConfig(cfg, recordHook)
+	if err != nil {
+		zap.S().Fatalf("create proxy failed: %v", err)
+	}
+	p.ConnHook = recordConnHook
+	setHooks(cfg)
+	if err := applyTracing(p, &cfg.Tracing); err != nil {
+		zap.S().Fatalf("invalid tracing: %v", err)
+	}
+	if err := applyAccessLog(p, &cfg.AccessLog); err != nil {
+		zap.S().Fatalf("open access log failed: %v", err)
+	}
+	admin := serveAdmin(p, cfg.Admin)
+	reloadConfig(cmd, p, override)
+
+	servers := make([]*http.Server, 0, len(cfg.Listen))
+	errs := make(chan error, len(cfg.Listen))
+	for _, addr := range cfg.Listen {
+		srv := &http.Server{Addr: addr, Handler: p}
+		p.ConfigureServer(srv)
+		servers = append(servers, srv)
+		zap.S().Infof("Proxy server is hosting on %v", addr)
+		go func() {
+			errs <- srv.ListenAndServe()
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		zap.S().Infof("got %v, shutting down", sig)
+		shutdown(p, servers, admin, stop)
+	case err := <-errs:
+		zap.S().Errorf("proxy server stopped: %v", err)
+		shutdown(p, servers, admin, stop)
+		os.Exit(1)
+	}
+}
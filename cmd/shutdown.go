@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"go.uber.org/zap"
+)
+
+// FLUSHTIMEOUT bounds the export of the last spans on shutdown
+const FLUSHTIMEOUT = 5 * time.Second
+
+// shutdown stops accepting clients, drains the requests and the tunnels for
+// the shutdown timeout, or until another signal, then closes what is left
+// and flushes the logs, the spans and the cert cache
+func shutdown(p *proxy.ProxyServer, servers []*http.Server, admin *http.Server, stop <-chan os.Signal) {
+	confMu.Lock()
+	timeout := time.Duration(conf.ShutdownTimeout)
+	confMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-stop:
+			zap.S().Warnf("got %v again, closing the connections now", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.Shutdown(ctx)
+	}()
+	wg.Wait()
+	if ctx.Err() != nil {
+		zap.S().Warnf("the connections left were closed")
+	} else {
+		zap.S().Infof("all the connections are drained")
+	}
+
+	if admin != nil {
+		admin.Close()
+	}
+	if err := p.Close(); err != nil {
+		zap.S().Errorf("close the cert cache failed: %v", err)
+	}
+	if accessLog != nil {
+		if err := accessLog.Close(); err != nil {
+			zap.S().Errorf("close the access log failed: %v", err)
+		}
+	}
+	if tracerProvider != nil {
+		flushCtx, cancel := context.WithTimeout(context.Background(), FLUSHTIMEOUT)
+		defer cancel()
+		if err := tracerProvider.Shutdown(flushCtx); err != nil {
+			zap.S().Errorf("flush the spans failed: %v", err)
+		}
+	}
+	zap.S().Infof("Proxy server is stopped")
+	zap.L().Sync()
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	tlsPolicyFile     string
+	tlsMinVersion     string
+	tlsMaxVersion     string
+	tlsCipherSuites   []string
+	tlsCurves         []string
+	tlsALPN           []string
+	tlsSessionTickets bool
+	tlsClientAuth     string
+)
+
+func addTlsPolicyFlags(c *cobra.Command) {
+	def := proxy.DefaultTlsPolicy()
+	c.Flags().StringVarP(&tlsPolicyFile, "tls-policy", "", "", "Specify a json file with the tls policy for the clients, it replaces the one of the config and the flags below override it.")
+	c.Flags().StringVarP(&tlsMinVersion, "tls-min-version", "", def.MinVersion, "Specify the min tls version offered to the clients.")
+	c.Flags().StringVarP(&tlsMaxVersion, "tls-max-version", "", def.MaxVersion, "Specify the max tls version offered to the clients.")
+	c.Flags().StringSliceVarP(&tlsCipherSuites, "tls-ciphers", "", def.CipherSuites, "Specify the cipher suites offered to the clients, empty for the go defaults.")
+	c.Flags().StringSliceVarP(&tlsCurves, "tls-curves", "", def.Curves, "Specify the curves offered to the clients, empty for the go defaults.")
+	c.Flags().StringSliceVarP(&tlsALPN, "tls-alpn", "", def.ALPN, "Specify the ALPN protocols offered to the clients.")
+	c.Flags().BoolVarP(&tlsSessionTickets, "tls-session-tickets", "", def.SessionTickets, "Enable tls session tickets for the clients.")
+	c.Flags().StringVarP(&tlsClientAuth, "tls-client-auth", "", def.ClientAuth, "Ask the clients for a certificate: none, request or require.")
+}
+
+// applyTlsPolicyFlags replaces the policy of the config with the policy file
+// if any, then applies the flags set explicitly
+func applyTlsPolicyFlags(c *cobra.Command, tp *proxy.TlsPolicy) error {
+	if tlsPolicyFile != "" {
+		file, err := proxy.LoadTlsPolicy(tlsPolicyFile)
+		if err != nil {
+			return err
+		}
+		*tp = *file
+	}
+
+	flags := c.Flags()
+	if flags.Changed("tls-min-version") {
+		tp.MinVersion = tlsMinVersion
+	}
+	if flags.Changed("tls-max-version") {
+		tp.MaxVersion = tlsMaxVersion
+	}
+	if flags.Changed("tls-ciphers") {
+		tp.CipherSuites = tlsCipherSuites
+	}
+	if flags.Changed("tls-curves") {
+		tp.Curves = tlsCurves
+	}
+	if flags.Changed("tls-alpn") {
+		tp.ALPN = tlsALPN
+	}
+	if flags.Changed("tls-session-tickets") {
+		tp.SessionTickets = tlsSessionTickets
+	}
+	if flags.Changed("tls-client-auth") {
+		tp.ClientAuth = tlsClientAuth
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+// tracingFlags are the tracing flags, only the ones set explicitly override
+// the config
+var tracingFlags proxy.TracingConfig
+
+// tracerProvider exports the spans, nil when tracing is disabled
+var tracerProvider *sdktrace.TracerProvider
+
+func addTracingFlags(c *cobra.Command) {
+	def := proxy.DefaultConfig().Tracing
+	c.Flags().StringVarP(&tracingFlags.Endpoint, "otlp-endpoint", "", def.Endpoint, "Specify the otlp/http collector receiving the traces, e.g. localhost:4318, empty to disable tracing.")
+	c.Flags().BoolVarP(&tracingFlags.Insecure, "otlp-insecure", "", def.Insecure, "Send the traces to the collector over plain http.")
+	c.Flags().Float64VarP(&tracingFlags.Ratio, "trace-ratio", "", def.Ratio, "Specify the ratio of the traces started by the proxy to sample, from 0 to 1.")
+}
+
+func applyTracingFlags(c *cobra.Command, t *proxy.TracingConfig) {
+	flags := c.Flags()
+	if flags.Changed("otlp-endpoint") {
+		t.Endpoint = tracingFlags.Endpoint
+	}
+	if flags.Changed("otlp-insecure") {
+		t.Insecure = tracingFlags.Insecure
+	}
+	if flags.Changed("trace-ratio") {
+		t.Ratio = tracingFlags.Ratio
+	}
+}
+
+// applyTracing exports a span per request when a collector is given
+func applyTracing(p *proxy.ProxyServer, cfg *proxy.TracingConfig) error {
+	if cfg.Endpoint == "" {
+		return nil
+	}
+	tp, err := proxy.NewOtlpTracerProvider(cfg.Endpoint, cfg.Insecure, cfg.Ratio)
+	if err != nil {
+		return err
+	}
+	tracerProvider = tp
+	p.SetTracerProvider(tp)
+	zap.S().Infof("Tracing to %v", cfg.Endpoint)
+	return nil
+}
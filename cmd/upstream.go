@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"xiaolongbaoproxy/pkg/proxy"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	upstreamTlsFile  string
+	upstreamRootCAs  []string
+	upstreamInsecure []string
+	upstreamPins     []string
+	upstreamClients  []string
+)
+
+func addUpstreamTlsFlags(c *cobra.Command) {
+	c.Flags().StringVarP(&upstreamTlsFile, "upstream-tls", "", "", "Specify a json file describing the upstream tls verification, it replaces the one of the config and the flags below add to it.")
+	c.Flags().StringSliceVarP(&upstreamRootCAs, "upstream-ca", "", nil, "Specify PEM bundles trusted for the upstream servers, in addition to the system roots.")
+	c.Flags().StringSliceVarP(&upstreamInsecure, "upstream-insecure", "", nil, "Specify the upstream hosts (example.com or *.example.com) whose certificate is not verified.")
+	c.Flags().StringSliceVarP(&upstreamPins, "upstream-pin", "", nil, "Pin an upstream host to a sha256 certificate fingerprint, as host=fingerprint.")
+	c.Flags().StringArrayVarP(&upstreamClients, "upstream-client-cert", "", nil, "Present a client certificate to an upstream host, as host=cert.pem,key.pem.")
+}
+
+// applyUpstreamTlsFlags replaces the upstream tls of the config with the file
+// if any, then adds the flags
+func applyUpstreamTlsFlags(c *cobra.Command, u *proxy.UpstreamTls) error {
+	if upstreamTlsFile != "" {
+		file, err := proxy.LoadUpstreamTls(upstreamTlsFile)
+		if err != nil {
+			return err
+		}
+		*u = *file
+	}
+
+	u.RootCAs = append(u.RootCAs, upstreamRootCAs...)
+	u.InsecureHosts = append(u.InsecureHosts, upstreamInsecure...)
+	for _, pin := range upstreamPins {
+		kv := strings.SplitN(pin, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid upstream pin, expect host=fingerprint: %v", pin)
+		}
+		if u.Pins == nil {
+			u.Pins = make(map[string][]string)
+		}
+		u.Pins[kv[0]] = append(u.Pins[kv[0]], kv[1])
+	}
+	for _, client := range upstreamClients {
+		kv := strings.SplitN(client, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid upstream client cert, expect host=cert.pem,key.pem: %v", client)
+		}
+		files := strings.SplitN(kv[1], ",", 2)
+		if len(files) != 2 {
+			return fmt.Errorf("invalid upstream client cert, expect host=cert.pem,key.pem: %v", client)
+		}
+		u.ClientCerts = append(u.ClientCerts, proxy.ClientCert{Host: kv[0], Cert: files[0], Key: files[1]})
+	}
+	return nil
+}
@@ -3,8 +3,10 @@ package key
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -36,7 +38,11 @@ func LoadPKFromFile(filename string) (*PrivateKey, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParsePK(data)
+}
 
+// ParsePK decodes a PEM encoded private key
+func ParsePK(data []byte) (*PrivateKey, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, fmt.Errorf("unable to decode the pem file")
@@ -55,7 +61,11 @@ func LoadCertificateFromFile(filename string) (*Certificate, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParseCertificate(data)
+}
 
+// ParseCertificate decodes a PEM encoded certificate
+func ParseCertificate(data []byte) (*Certificate, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, fmt.Errorf("unable to decode the pem file")
@@ -65,10 +75,29 @@ func LoadCertificateFromFile(filename string) (*Certificate, error) {
 		return nil, fmt.Errorf("unable to decode x509 certificate")
 	}
 
-	return &Certificate{Cert: cert}, nil
+	return &Certificate{Cert: cert, DerBytes: block.Bytes}, nil
 }
 
+// CertificateForKey generates a new leaf key and signs a certificate for CN with the CA
 func CertificateForKey(CN string, key *PrivateKey, ca *Certificate) (*Certificate, *PrivateKey, error) {
+	priv, err := GeneratePrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return CertificateForPrivateKey(CN, priv, key, ca)
+}
+
+// GeneratePrivateKey generates a new 2048-bit rsa key for a leaf certificate
+func GeneratePrivateKey() (*PrivateKey, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{rsaKey: priv}, nil
+}
+
+// CertificateForPrivateKey signs a certificate for CN and the given leaf key with the CA
+func CertificateForPrivateKey(CN string, leaf *PrivateKey, key *PrivateKey, ca *Certificate) (*Certificate, *PrivateKey, error) {
 	// set up our server certificate template
 	template := &x509.Certificate{
 		SerialNumber: new(big.Int).SetInt64(int64(time.Now().UnixNano())),
@@ -89,9 +118,8 @@ func CertificateForKey(CN string, key *PrivateKey, ca *Certificate) (*Certificat
 		template.IPAddresses = []net.IP{ip}
 	}
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	// sign the cert with root CA
-	signedBytes, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, priv.Public(), key.rsaKey)
+	signedBytes, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, leaf.rsaKey.Public(), key.rsaKey)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -101,7 +129,7 @@ func CertificateForKey(CN string, key *PrivateKey, ca *Certificate) (*Certificat
 		return nil, nil, err
 	}
 
-	return &Certificate{Cert: signedCert, DerBytes: signedBytes}, &PrivateKey{rsaKey: priv}, nil
+	return &Certificate{Cert: signedCert, DerBytes: signedBytes}, leaf, nil
 }
 
 func (k *PrivateKey) pemBlock() *pem.Block {
@@ -119,3 +147,24 @@ func (c *Certificate) pemBlock() *pem.Block {
 func (c *Certificate) PEMEncoded() (pemBytes []byte) {
 	return pem.EncodeToMemory(c.pemBlock())
 }
+
+// Fingerprint returns the hex encoded sha256 of the DER certificate
+func (c *Certificate) Fingerprint() string {
+	sum := sha256.Sum256(c.DerBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateCA checks that the private key belongs to the CA certificate
+func ValidateCA(cert *Certificate, pk *PrivateKey) error {
+	if cert == nil || cert.Cert == nil || pk == nil || pk.rsaKey == nil {
+		return fmt.Errorf("missing CA certificate or private key")
+	}
+	pub, ok := cert.Cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the CA certificate does not hold an rsa public key")
+	}
+	if pub.N.Cmp(pk.rsaKey.N) != 0 || pub.E != pk.rsaKey.E {
+		return fmt.Errorf("the private key does not match the CA certificate")
+	}
+	return nil
+}
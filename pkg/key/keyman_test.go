@@ -0,0 +1,81 @@
+package key
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T) (*Certificate, *PrivateKey) {
+	t.Helper()
+	pk, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &pk.rsaKey.PublicKey, pk.rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Certificate{Cert: cert, DerBytes: der}, pk
+}
+
+func TestValidateCA(t *testing.T) {
+	cert, pk := newTestCA(t)
+	_, otherPk := newTestCA(t)
+	tests := []struct {
+		name    string
+		cert    *Certificate
+		pk      *PrivateKey
+		wantErr bool
+	}{
+		{"matching", cert, pk, false},
+		{"other key", cert, otherPk, true},
+		{"no cert", nil, pk, true},
+		{"no key", cert, nil, true},
+		{"empty key", cert, &PrivateKey{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCA(tt.cert, tt.pk); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCertificateForPrivateKey(t *testing.T) {
+	cacert, cakey := newTestCA(t)
+	leaf, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, pk, err := CertificateForPrivateKey("127.0.0.1", leaf, cakey, cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk != leaf {
+		t.Fatal("the leaf key was not used")
+	}
+	if err := cert.Cert.CheckSignatureFrom(cacert.Cert); err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Cert.IPAddresses) != 1 || cert.Fingerprint() == cacert.Fingerprint() {
+		t.Fatalf("unexpected leaf %+v", cert.Cert)
+	}
+}
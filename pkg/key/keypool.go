@@ -0,0 +1,87 @@
+package key
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// KEYPOOL_RETRY is how long the generator waits after a failed generation
+const KEYPOOL_RETRY = time.Second
+
+// KeyPool keeps a number of pre-generated leaf keys, so issuing a leaf
+// certificate does not block on rsa key generation
+type KeyPool struct {
+	keys     chan *PrivateKey
+	quit     chan struct{}
+	quitOnce sync.Once
+	generate func() (*PrivateKey, error)
+	retry    time.Duration
+}
+
+// NewKeyPool starts a background generator which keeps up to size keys ready
+func NewKeyPool(size int) *KeyPool {
+	return newKeyPool(size, GeneratePrivateKey, KEYPOOL_RETRY)
+}
+
+func newKeyPool(size int, generate func() (*PrivateKey, error), retry time.Duration) *KeyPool {
+	p := &KeyPool{
+		keys:     make(chan *PrivateKey, size),
+		quit:     make(chan struct{}),
+		generate: generate,
+		retry:    retry,
+	}
+	go p.fill()
+	return p
+}
+
+func (p *KeyPool) fill() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+		k, err := p.generate()
+		if err != nil {
+			// logged with the cert cache it feeds
+			zap.S().Named("keycache").Errorf("[keypool] fail to generate a key: %v", err)
+			select {
+			case <-time.After(p.retry):
+				continue
+			case <-p.quit:
+				return
+			}
+		}
+		select {
+		case p.keys <- k:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Get returns a pre-generated key, or generates one if the pool is empty.
+// A nil pool always generates a new key.
+func (p *KeyPool) Get() (*PrivateKey, error) {
+	if p == nil {
+		return GeneratePrivateKey()
+	}
+	select {
+	case k := <-p.keys:
+		return k, nil
+	default:
+		return GeneratePrivateKey()
+	}
+}
+
+// Close stops the background generator
+func (p *KeyPool) Close() {
+	if p == nil {
+		return
+	}
+	p.quitOnce.Do(func() {
+		close(p.quit)
+	})
+}
@@ -0,0 +1,63 @@
+package key
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyPoolGet(t *testing.T) {
+	p := NewKeyPool(2)
+	defer p.Close()
+
+	// wait for the generator to fill the pool
+	deadline := time.Now().Add(10 * time.Second)
+	for len(p.keys) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the pool was not filled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	seen := make(map[*PrivateKey]bool)
+	for i := 0; i < 3; i++ {
+		k, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k == nil || seen[k] {
+			t.Fatalf("key %v was handed out twice", i)
+		}
+		seen[k] = true
+	}
+}
+
+func TestNilKeyPoolGenerates(t *testing.T) {
+	var p *KeyPool
+	k, err := p.Get()
+	if err != nil || k == nil {
+		t.Fatalf("got %v, %v", k, err)
+	}
+	p.Close()
+}
+
+func TestKeyPoolBacksOffOnError(t *testing.T) {
+	var calls int32
+	p := newKeyPool(2, func() (*PrivateKey, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("no entropy")
+	}, 50*time.Millisecond)
+
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n < 1 || n > 6 {
+		t.Errorf("%v generations in 200ms with a 50ms retry", n)
+	}
+	p.Close()
+	// a generation may be running while the pool is closed
+	time.Sleep(100 * time.Millisecond)
+	closed := atomic.LoadInt32(&calls)
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != closed {
+		t.Errorf("%v generations after the pool was closed", n-closed)
+	}
+}
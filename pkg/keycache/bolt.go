@@ -0,0 +1,231 @@
+package keycache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync/atomic"
+	"time"
+	"xiaolongbaoproxy/pkg/key"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	CABUCKET   = "MITMCA"
+	CERTBUCKET = "MITMCERT"
+	KEYBUCKET  = "MITMKEY"
+	// CAFPBUCKET keeps the fingerprint of the CA which issued each cert
+	CAFPBUCKET = "MITMCAFP"
+)
+
+const (
+	// LRUSIZE is the max number of parsed key pairs kept in memory
+	LRUSIZE = 1024
+	// LRUTTL is how long a parsed key pair stays in memory
+	LRUTTL = time.Hour
+	// BOLTTIMEOUT is how long to wait for the database lock held by another process
+	BOLTTIMEOUT = time.Second
+)
+
+// BoltCertCache keeps the key pairs in a bbolt database
+type BoltCertCache struct {
+	Db *bolt.DB
+
+	ca     *caHolder
+	lru    *lruCache
+	hits   int64
+	misses int64
+}
+
+func NewBoltCertCache(cachepath string, cacert *key.Certificate) (*BoltCertCache, error) {
+	db, err := bolt.Open(cachepath, 0666, &bolt.Options{Timeout: BOLTTIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(t *bolt.Tx) error {
+		// certs are now checked against the CA one by one, the old CA
+		// bucket (which also kept the CA private key) is not needed
+		if t.Bucket([]byte(CABUCKET)) != nil {
+			if err := t.DeleteBucket([]byte(CABUCKET)); err != nil {
+				return err
+			}
+		}
+
+		for _, name := range []string{CERTBUCKET, KEYBUCKET, CAFPBUCKET} {
+			if _, err := t.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	certCache := &BoltCertCache{
+		Db:  db,
+		ca:  newCaHolder(cacert),
+		lru: newLruCache(LRUSIZE, LRUTTL),
+	}
+	certCache.lru.SwitchCA(cacert.Fingerprint())
+
+	return certCache, nil
+}
+
+func (c *BoltCertCache) GetKeyPair(host string) (*tls.Certificate, error) {
+	if keypair, ok := c.lru.Get(host); ok {
+		if validLeaf(keypair) {
+			atomic.AddInt64(&c.hits, 1)
+			return keypair, nil
+		}
+		c.lru.Remove(host)
+	}
+	// a key pair read from the store is a hit too
+	keypair, err := c.loadKeyPair(host)
+	if err != nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return keypair, nil
+}
+
+// loadKeyPair reads the key pair of host from the store into the lru
+func (c *BoltCertCache) loadKeyPair(host string) (*tls.Certificate, error) {
+	var certDerBytes []byte
+	var keyBytes []byte
+	var caFingerprint string
+	err := c.Db.View(func(t *bolt.Tx) error {
+		certBucket := t.Bucket([]byte(CERTBUCKET))
+		keyBucket := t.Bucket([]byte(KEYBUCKET))
+		caBucket := t.Bucket([]byte(CAFPBUCKET))
+
+		// the slices are only valid during the transaction, so copy them out
+		certDerBytes = append([]byte(nil), certBucket.Get([]byte(host))...)
+		keyBytes = append([]byte(nil), keyBucket.Get([]byte(host))...)
+		caFingerprint = string(caBucket.Get([]byte(host)))
+
+		if len(certDerBytes) == 0 || len(keyBytes) == 0 {
+			return errNotFound
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	if caFingerprint != c.ca.Fingerprint() {
+		return nil, errStaleCA
+	}
+
+	keypair, err := parseKeyPair(certDerBytes, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	// SetCA may have switched since the check above
+	if !c.lru.AddIssuedBy(host, keypair, caFingerprint) {
+		return nil, errStaleCA
+	}
+
+	return keypair, nil
+}
+
+func (c *BoltCertCache) SetKeyPair(host string, certBytes, keyBytes []byte) error {
+	if !c.ca.issued(certBytes) {
+		return errStaleCA
+	}
+
+	err := c.Db.Update(func(t *bolt.Tx) error {
+		certBucket := t.Bucket([]byte(CERTBUCKET))
+		err := certBucket.Put([]byte(host), certBytes)
+		if err != nil {
+			return err
+		}
+
+		keyBucket := t.Bucket([]byte(KEYBUCKET))
+		err = keyBucket.Put([]byte(host), keyBytes)
+		if err != nil {
+			return err
+		}
+
+		caBucket := t.Bucket([]byte(CAFPBUCKET))
+		err = caBucket.Put([]byte(host), []byte(c.ca.Fingerprint()))
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	// drop the stale parsed key pair, the next get will load the new one
+	c.lru.Remove(host)
+
+	return nil
+}
+
+func (c *BoltCertCache) List() ([]*Entry, error) {
+	var entries []*Entry
+	err := c.Db.View(func(t *bolt.Tx) error {
+		caBucket := t.Bucket([]byte(CAFPBUCKET))
+		return t.Bucket([]byte(CERTBUCKET)).ForEach(func(k, v []byte) error {
+			cert, err := x509.ParseCertificate(v)
+			if err != nil {
+				// keep listing, a broken entry can still be purged
+				cert = nil
+			}
+			entries = append(entries, &Entry{
+				Host:          string(k),
+				Cert:          cert,
+				CAFingerprint: string(caBucket.Get(k)),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *BoltCertCache) Delete(host string) error {
+	err := c.Db.Update(func(t *bolt.Tx) error {
+		for _, name := range []string{CERTBUCKET, KEYBUCKET, CAFPBUCKET} {
+			if err := t.Bucket([]byte(name)).Delete([]byte(host)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.lru.Remove(host)
+
+	return nil
+}
+
+// SetCA switches to a new CA, the certs issued by the old one become misses
+func (c *BoltCertCache) SetCA(cacert *key.Certificate) {
+	c.ca.Store(cacert)
+	c.lru.SwitchCA(cacert.Fingerprint())
+}
+
+// Stats returns the hit/miss counters of the in-memory tier
+func (c *BoltCertCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+		Size:   c.lru.Len(),
+	}
+}
+
+func (c *BoltCertCache) Close() error {
+	return c.Db.Close()
+}
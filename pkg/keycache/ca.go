@@ -0,0 +1,46 @@
+package keycache
+
+import (
+	"crypto/x509"
+	"sync/atomic"
+	"xiaolongbaoproxy/pkg/key"
+)
+
+type caInfo struct {
+	cert        *key.Certificate
+	fingerprint string
+}
+
+// caHolder keeps the current CA of a cache, it can be swapped while
+// the cache is in use
+type caHolder struct {
+	v atomic.Value
+}
+
+func newCaHolder(cacert *key.Certificate) *caHolder {
+	h := &caHolder{}
+	h.Store(cacert)
+	return h
+}
+
+func (h *caHolder) Store(cacert *key.Certificate) {
+	h.v.Store(&caInfo{cert: cacert, fingerprint: cacert.Fingerprint()})
+}
+
+func (h *caHolder) Cert() *key.Certificate {
+	return h.v.Load().(*caInfo).cert
+}
+
+func (h *caHolder) Fingerprint() string {
+	return h.v.Load().(*caInfo).fingerprint
+}
+
+// issued tells whether the DER cert is signed by the current CA, so a leaf
+// issued by a CA which was rotated out in the meantime is not stored
+func (h *caHolder) issued(certDerBytes []byte) bool {
+	cert, err := x509.ParseCertificate(certDerBytes)
+	if err != nil {
+		return false
+	}
+	return cert.CheckSignatureFrom(h.Cert().Cert) == nil
+}
@@ -0,0 +1,232 @@
+package keycache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"xiaolongbaoproxy/pkg/key"
+)
+
+const (
+	DIRCERTEXT = ".crt"
+	DIRKEYEXT  = ".key"
+)
+
+// DirCertCache keeps the key pairs as PEM files in a directory, one
+// <host>.crt and <host>.key per host, so that several proxies can share
+// pre-issued certs. The .crt file holds the leaf followed by the issuing CA.
+type DirCertCache struct {
+	Dir string
+
+	ca     *caHolder
+	lru    *lruCache
+	hits   int64
+	misses int64
+}
+
+func NewDirCertCache(dir string, cacert *key.Certificate) (*DirCertCache, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("empty cert cache directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &DirCertCache{
+		Dir: dir,
+		ca:  newCaHolder(cacert),
+		lru: newLruCache(LRUSIZE, LRUTTL),
+	}
+	c.lru.SwitchCA(cacert.Fingerprint())
+	return c, nil
+}
+
+func (c *DirCertCache) paths(host string) (string, string, error) {
+	if host == "" || strings.ContainsAny(host, `/\`) || strings.HasPrefix(host, ".") {
+		return "", "", fmt.Errorf("invalid host name for cert cache: %q", host)
+	}
+	return filepath.Join(c.Dir, host+DIRCERTEXT), filepath.Join(c.Dir, host+DIRKEYEXT), nil
+}
+
+// readChain returns the DER leaf and the fingerprint of the CA from a .crt file
+func readChain(certPath string) ([]byte, string, error) {
+	certPem, err := ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return nil, "", errNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	leaf, rest := pem.Decode(certPem)
+	if leaf == nil {
+		return nil, "", fmt.Errorf("unable to decode the pem file: %v", certPath)
+	}
+	caFingerprint := ""
+	if ca, _ := pem.Decode(rest); ca != nil {
+		caFingerprint = (&key.Certificate{DerBytes: ca.Bytes}).Fingerprint()
+	}
+	return leaf.Bytes, caFingerprint, nil
+}
+
+func (c *DirCertCache) GetKeyPair(host string) (*tls.Certificate, error) {
+	if keypair, ok := c.lru.Get(host); ok {
+		if validLeaf(keypair) {
+			atomic.AddInt64(&c.hits, 1)
+			return keypair, nil
+		}
+		c.lru.Remove(host)
+	}
+	// a key pair read from the store is a hit too
+	keypair, err := c.loadKeyPair(host)
+	if err != nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return keypair, nil
+}
+
+// loadKeyPair reads the key pair of host from the store into the lru
+func (c *DirCertCache) loadKeyPair(host string) (*tls.Certificate, error) {
+	certPath, keyPath, err := c.paths(host)
+	if err != nil {
+		return nil, err
+	}
+	certDerBytes, caFingerprint, err := readChain(certPath)
+	if err != nil {
+		return nil, err
+	}
+	if caFingerprint != c.ca.Fingerprint() {
+		return nil, errStaleCA
+	}
+	keyBytes, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	keypair, err := parseKeyPair(certDerBytes, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	// SetCA may have switched since the check above
+	if !c.lru.AddIssuedBy(host, keypair, caFingerprint) {
+		return nil, errStaleCA
+	}
+
+	return keypair, nil
+}
+
+func (c *DirCertCache) SetKeyPair(host string, certBytes, keyBytes []byte) error {
+	if !c.ca.issued(certBytes) {
+		return errStaleCA
+	}
+	certPath, keyPath, err := c.paths(host)
+	if err != nil {
+		return err
+	}
+
+	// write the key first, a reader only picks the pair up once the cert exists
+	if err := writeFileAtomic(keyPath, keyBytes, 0600); err != nil {
+		return err
+	}
+	chain := append((&key.Certificate{DerBytes: certBytes}).PEMEncoded(), c.ca.Cert().PEMEncoded()...)
+	if err := writeFileAtomic(certPath, chain, 0644); err != nil {
+		return err
+	}
+	c.lru.Remove(host)
+
+	return nil
+}
+
+func (c *DirCertCache) List() ([]*Entry, error) {
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != DIRCERTEXT {
+			continue
+		}
+		host := strings.TrimSuffix(f.Name(), DIRCERTEXT)
+		entry := &Entry{Host: host}
+		certDerBytes, caFingerprint, err := readChain(filepath.Join(c.Dir, f.Name()))
+		if err == nil {
+			// keep listing, a broken entry can still be purged
+			entry.Cert, _ = x509.ParseCertificate(certDerBytes)
+			entry.CAFingerprint = caFingerprint
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Host < entries[j].Host
+	})
+	return entries, nil
+}
+
+func (c *DirCertCache) Delete(host string) error {
+	certPath, keyPath, err := c.paths(host)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(certPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.lru.Remove(host)
+
+	return nil
+}
+
+// SetCA switches to a new CA, the certs issued by the old one become misses
+func (c *DirCertCache) SetCA(cacert *key.Certificate) {
+	c.ca.Store(cacert)
+	c.lru.SwitchCA(cacert.Fingerprint())
+}
+
+func (c *DirCertCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+		Size:   c.lru.Len(),
+	}
+}
+
+func (c *DirCertCache) Close() error {
+	return nil
+}
+
+// writeFileAtomic writes to a temp file and renames it, so a concurrent
+// reader never sees a partially written file
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,553 @@
+package keycache
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"xiaolongbaoproxy/pkg/key"
+)
+
+// signLeaf issues a leaf for host which expires at notAfter, the cert is
+// DER and the key PEM encoded like the caches store them
+func signLeaf(t *testing.T, cacert *key.Certificate, cakey *key.PrivateKey, host string, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	block, _ := pem.Decode(cakey.PEMEncoded())
+	caRsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, cacert.Cert, leafKey.Public(), caRsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_PRIVATE_KEY, Bytes: x509.MarshalPKCS1PrivateKey(leafKey)})
+	return der, keyPem
+}
+
+// newTestCA writes a self-signed CA into dir and loads it back
+func newTestCA(t *testing.T, dir string) (*key.Certificate, *key.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, rsaKey.Public(), rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "ca.crt")
+	keyPath := filepath.Join(dir, "ca.key")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_CERTIFICATE, Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_PRIVATE_KEY, Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := ioutil.WriteFile(certPath, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := key.LoadCertificateFromFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := key.LoadPKFromFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pk
+}
+
+func newTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "keycache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLruCache(t *testing.T) {
+	a, b, c := &tls.Certificate{}, &tls.Certificate{}, &tls.Certificate{}
+	tests := []struct {
+		name     string
+		capacity int
+		ttl      time.Duration
+		run      func(l *lruCache)
+		present  []string
+		absent   []string
+	}{
+		{
+			name:     "evicts the least recently used",
+			capacity: 2,
+			ttl:      time.Hour,
+			run: func(l *lruCache) {
+				l.Add("a", a)
+				l.Add("b", b)
+				l.Get("a")
+				l.Add("c", c)
+			},
+			present: []string{"a", "c"},
+			absent:  []string{"b"},
+		},
+		{
+			name:     "updates in place",
+			capacity: 2,
+			ttl:      time.Hour,
+			run: func(l *lruCache) {
+				l.Add("a", a)
+				l.Add("b", b)
+				l.Add("a", c)
+			},
+			present: []string{"a", "b"},
+		},
+		{
+			name:     "expires after the ttl",
+			capacity: 2,
+			ttl:      time.Millisecond,
+			run: func(l *lruCache) {
+				l.Add("a", a)
+				time.Sleep(5 * time.Millisecond)
+			},
+			absent: []string{"a"},
+		},
+		{
+			name:     "removes and switches the CA",
+			capacity: 3,
+			ttl:      time.Hour,
+			run: func(l *lruCache) {
+				l.Add("a", a)
+				l.Add("b", b)
+				l.Add("c", c)
+				l.Remove("a")
+				l.SwitchCA("other")
+			},
+			absent: []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLruCache(tt.capacity, tt.ttl)
+			tt.run(l)
+			for _, host := range tt.present {
+				if _, ok := l.Get(host); !ok {
+					t.Errorf("%v should be cached", host)
+				}
+			}
+			for _, host := range tt.absent {
+				if _, ok := l.Get(host); ok {
+					t.Errorf("%v should not be cached", host)
+				}
+			}
+			if l.Len() != len(tt.present) {
+				t.Errorf("len = %v, want %v", l.Len(), len(tt.present))
+			}
+		})
+	}
+}
+
+func TestLruCacheUpdateKeepsTheNewKeyPair(t *testing.T) {
+	l := newLruCache(1, time.Hour)
+	old, renewed := &tls.Certificate{}, &tls.Certificate{}
+	l.Add("a", old)
+	l.Add("a", renewed)
+	if got, _ := l.Get("a"); got != renewed {
+		t.Fatal("the update did not replace the key pair")
+	}
+}
+
+func TestLruCacheDropsKeyPairsOfASwitchedCA(t *testing.T) {
+	l := newLruCache(2, time.Hour)
+	l.SwitchCA("old")
+	if !l.AddIssuedBy("a", &tls.Certificate{}, "old") {
+		t.Fatal("a key pair of the current CA was dropped")
+	}
+	l.SwitchCA("new")
+	// a load which checked the CA before the switch
+	if l.AddIssuedBy("b", &tls.Certificate{}, "old") {
+		t.Error("a key pair of the previous CA was added")
+	}
+	if l.Len() != 0 {
+		t.Errorf("len = %v after the switch, want 0", l.Len())
+	}
+}
+
+// cacheUris are the backends under test, %v is a fresh directory
+var cacheUris = []struct {
+	name string
+	uri  string
+}{
+	{"mem", MEMSCHEME},
+	{"dir", DIRSCHEME + "%v/certs"},
+	{"bolt", BOLTSCHEME + "%v/cache.db"},
+	{"bolt without scheme", "%v/cache.db"},
+}
+
+func TestCertCacheRoundTrip(t *testing.T) {
+	for _, tt := range cacheUris {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTempDir(t)
+			defer os.RemoveAll(dir)
+			cacert, cakey := newTestCA(t, dir)
+
+			c, err := NewCertCache(strings.Replace(tt.uri, "%v", dir, 1), cacert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := c.GetKeyPair("example.com"); err == nil {
+				t.Fatal("an empty cache returned a key pair")
+			}
+			leaf, leafKey, err := key.CertificateForKey("example.com", cakey, cacert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.SetKeyPair("example.com", leaf.DerBytes, leafKey.PEMEncoded()); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				keypair, err := c.GetKeyPair("example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if keypair.Leaf == nil || keypair.Leaf.Subject.CommonName != "example.com" {
+					t.Fatalf("unexpected leaf %v", keypair.Leaf)
+				}
+			}
+			// the first lookup after the store reads it from the disk, both
+			// are hits
+			if stats := c.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNewCertCacheUnknownScheme(t *testing.T) {
+	if _, err := NewCertCache("redis://localhost", nil); err == nil {
+		t.Fatal("an unknown scheme was accepted")
+	}
+}
+
+func TestDirCertCacheRejectsPaths(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	cacert, cakey := newTestCA(t, dir)
+	c, err := NewDirCertCache(filepath.Join(dir, "certs"), cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, leafKey, err := key.CertificateForKey("example.com", cakey, cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"", "../example.com", ".example.com", `a\b`} {
+		if err := c.SetKeyPair(host, leaf.DerBytes, leafKey.PEMEncoded()); err == nil {
+			t.Errorf("host %q was written", host)
+		}
+	}
+}
+
+// diskUris are the backends which keep the entries across restarts
+var diskUris = cacheUris[1:]
+
+func TestCertCacheChecksTheIssuingCA(t *testing.T) {
+	for _, tt := range diskUris {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTempDir(t)
+			defer os.RemoveAll(dir)
+			uri := strings.Replace(tt.uri, "%v", dir, 1)
+			oldCert, oldKey := newTestCA(t, dir)
+			newCert, _ := newTestCA(t, dir)
+
+			c, err := NewCertCache(uri, oldCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := IssueKeyPair(c, "example.com", mustGenerateKey(t), oldKey, oldCert); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+
+			// the entry is kept but not served under another CA
+			c, err = NewCertCache(uri, newCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := c.GetKeyPair("example.com"); err == nil {
+				t.Fatal("a cert of the old CA was served")
+			}
+			entries, err := c.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].CAFingerprint != oldCert.Fingerprint() {
+				t.Fatalf("unexpected entries %+v", entries)
+			}
+		})
+	}
+}
+
+func TestCertCacheRenewsBeforeExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		notAfter time.Duration
+		served   bool
+	}{
+		{"valid", 30 * 24 * time.Hour, true},
+		{"in the renewal window", RENEWBEFORE / 2, false},
+		{"expired", -time.Hour, false},
+	}
+	for _, backend := range diskUris {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				dir := newTempDir(t)
+				defer os.RemoveAll(dir)
+				cacert, cakey := newTestCA(t, dir)
+				c, err := NewCertCache(strings.Replace(backend.uri, "%v", dir, 1), cacert)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+
+				der, keyPem := signLeaf(t, cacert, cakey, "example.com", time.Now().Add(tt.notAfter))
+				if err := c.SetKeyPair("example.com", der, keyPem); err != nil {
+					t.Fatal(err)
+				}
+				_, err = c.GetKeyPair("example.com")
+				if served := err == nil; served != tt.served {
+					t.Fatalf("served = %v, want %v (%v)", served, tt.served, err)
+				}
+			})
+		}
+	}
+}
+
+func TestMemCertCacheRejectsLeavesToRenew(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	cacert, cakey := newTestCA(t, dir)
+	c := NewMemCertCache(cacert)
+	der, keyPem := signLeaf(t, cacert, cakey, "example.com", time.Now().Add(RENEWBEFORE/2))
+	if err := c.SetKeyPair("example.com", der, keyPem); err == nil {
+		t.Fatal("a leaf in the renewal window was stored")
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	cacert, cakey := newTestCA(t, dir)
+	c, err := NewCertCache(BOLTSCHEME+filepath.Join(dir, "cache.db"), cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for host, notAfter := range map[string]time.Duration{
+		"expired.com":  -time.Hour,
+		"renewing.com": RENEWBEFORE / 2,
+		"valid.com":    30 * 24 * time.Hour,
+	} {
+		der, keyPem := signLeaf(t, cacert, cakey, host, time.Now().Add(notAfter))
+		if err := c.SetKeyPair(host, der, keyPem); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := PurgeExpired(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("purged %v entries, want 1", n)
+	}
+	if hosts := listHosts(t, c); strings.Join(hosts, ",") != "renewing.com,valid.com" {
+		t.Fatalf("left %v", hosts)
+	}
+}
+
+func TestSweeperRemovesExpiredEntries(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	cacert, cakey := newTestCA(t, dir)
+	c, err := NewCertCache(DIRSCHEME+filepath.Join(dir, "certs"), cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	der, keyPem := signLeaf(t, cacert, cakey, "expired.com", time.Now().Add(-time.Hour))
+	if err := c.SetKeyPair("expired.com", der, keyPem); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IssueKeyPair(c, "valid.com", mustGenerateKey(t), cakey, cacert); err != nil {
+		t.Fatal(err)
+	}
+
+	s := StartSweeper(c, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listHosts(t, c)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the expired entry was not swept: %v", listHosts(t, c))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+	s.Stop()
+	if hosts := listHosts(t, c); hosts[0] != "valid.com" {
+		t.Fatalf("swept the wrong entry, left %v", hosts)
+	}
+}
+
+func listHosts(t *testing.T, c CertCache) []string {
+	t.Helper()
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make([]string, 0, len(entries))
+	for _, e := range entries {
+		hosts = append(hosts, e.Host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func mustGenerateKey(t *testing.T) *key.PrivateKey {
+	t.Helper()
+	k, err := key.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestCertCacheSetCA(t *testing.T) {
+	for _, tt := range cacheUris {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTempDir(t)
+			defer os.RemoveAll(dir)
+			oldCert, oldKey := newTestCA(t, dir)
+			newCert, newKey := newTestCA(t, dir)
+
+			c, err := NewCertCache(strings.Replace(tt.uri, "%v", dir, 1), oldCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := IssueKeyPair(c, "example.com", mustGenerateKey(t), oldKey, oldCert); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.GetKeyPair("example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			c.SetCA(newCert)
+			if _, err := c.GetKeyPair("example.com"); err == nil {
+				t.Fatal("a cert of the old CA was served after SetCA")
+			}
+			// a leaf issued by the old CA while rotating is not stored
+			old, oldLeafKey, err := key.CertificateForKey("example.com", oldKey, oldCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.SetKeyPair("example.com", old.DerBytes, oldLeafKey.PEMEncoded()); err == nil {
+				t.Fatal("a cert of the old CA was stored after SetCA")
+			}
+			if _, err := IssueKeyPair(c, "example.com", mustGenerateKey(t), newKey, newCert); err != nil {
+				t.Fatal(err)
+			}
+			keypair, err := c.GetKeyPair("example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := keypair.Leaf.CheckSignatureFrom(newCert.Cert); err != nil {
+				t.Fatalf("served a leaf of another CA: %v", err)
+			}
+		})
+	}
+}
+
+func TestCertCacheSetCAWhileLoading(t *testing.T) {
+	for _, tt := range diskUris {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTempDir(t)
+			defer os.RemoveAll(dir)
+			oldCert, oldKey := newTestCA(t, dir)
+			newCert, _ := newTestCA(t, dir)
+			c, err := NewCertCache(strings.Replace(tt.uri, "%v", dir, 1), oldCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			leafKey := mustGenerateKey(t)
+			var hosts []string
+			for i := 0; i < 32; i++ {
+				host := fmt.Sprintf("host%v.example.com", i)
+				if _, err := IssueKeyPair(c, host, leafKey, oldKey, oldCert); err != nil {
+					t.Fatal(err)
+				}
+				hosts = append(hosts, host)
+			}
+
+			for i := 0; i < 20; i++ {
+				// the entries are on disk only, the readers load them
+				// while the CA is switched
+				c.SetCA(oldCert)
+				var wg sync.WaitGroup
+				for r := 0; r < 4; r++ {
+					wg.Add(1)
+					go func(r int) {
+						defer wg.Done()
+						for j := r; j < len(hosts); j += 4 {
+							c.GetKeyPair(hosts[j])
+						}
+					}(r)
+				}
+				time.Sleep(time.Duration(i%4) * 100 * time.Microsecond)
+				c.SetCA(newCert)
+				wg.Wait()
+				for _, host := range hosts {
+					if _, err := c.GetKeyPair(host); err == nil {
+						t.Fatalf("round %v: a cert of the old CA was served for %v after SetCA", i, host)
+					}
+				}
+			}
+		})
+	}
+}
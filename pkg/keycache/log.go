@@ -0,0 +1,10 @@
+package keycache
+
+import "go.uber.org/zap"
+
+// LOGGERNAME is the name of the logger of the cert cache
+const LOGGERNAME = "keycache"
+
+func logger() *zap.SugaredLogger {
+	return zap.S().Named(LOGGERNAME)
+}
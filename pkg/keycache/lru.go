@@ -0,0 +1,123 @@
+package keycache
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// lruEntry is one parsed key pair kept in memory
+type lruEntry struct {
+	host     string
+	keypair  *tls.Certificate
+	expireAt time.Time
+}
+
+// lruCache is a size bounded, ttl aware cache of parsed key pairs,
+// it sits in front of the persistent store so that the tls handshake
+// does not need to touch the disk
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+	// caFingerprint is the CA the key pairs added by AddIssuedBy belong to
+	caFingerprint string
+}
+
+func newLruCache(capacity int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(host string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[host]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if c.ttl > 0 && time.Now().After(entry.expireAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.keypair, true
+}
+
+func (c *lruCache) Add(host string, keypair *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.add(host, keypair)
+}
+
+// AddIssuedBy adds a key pair issued by the CA with caFingerprint, it is
+// dropped if SwitchCA moved to another CA meanwhile
+func (c *lruCache) AddIssuedBy(host string, keypair *tls.Certificate, caFingerprint string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if caFingerprint != c.caFingerprint {
+		return false
+	}
+	c.add(host, keypair)
+	return true
+}
+
+func (c *lruCache) add(host string, keypair *tls.Certificate) {
+	expireAt := time.Now().Add(c.ttl)
+	if elem, ok := c.items[host]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.keypair = keypair
+		entry.expireAt = expireAt
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	elem := c.ll.PushFront(&lruEntry{host: host, keypair: keypair, expireAt: expireAt})
+	c.items[host] = elem
+	if c.capacity > 0 && c.ll.Len() > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lruCache) Remove(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[host]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// SwitchCA purges the cache, only the key pairs of the CA with caFingerprint
+// are added from now on
+func (c *lruCache) SwitchCA(caFingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.caFingerprint = caFingerprint
+}
+
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *lruCache) removeElement(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry).host)
+}
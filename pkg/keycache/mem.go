@@ -0,0 +1,105 @@
+package keycache
+
+import (
+	"crypto/tls"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"xiaolongbaoproxy/pkg/key"
+)
+
+type memEntry struct {
+	keypair       *tls.Certificate
+	caFingerprint string
+}
+
+// MemCertCache keeps the key pairs in memory only, useful for ephemeral proxies
+type MemCertCache struct {
+	ca       *caHolder
+	mu       sync.RWMutex
+	keypairs map[string]*memEntry
+
+	hits   int64
+	misses int64
+}
+
+func NewMemCertCache(cacert *key.Certificate) *MemCertCache {
+	return &MemCertCache{
+		ca:       newCaHolder(cacert),
+		keypairs: make(map[string]*memEntry),
+	}
+}
+
+func (c *MemCertCache) GetKeyPair(host string) (*tls.Certificate, error) {
+	c.mu.RLock()
+	entry, ok := c.keypairs[host]
+	c.mu.RUnlock()
+
+	if !ok || !validLeaf(entry.keypair) || entry.caFingerprint != c.ca.Fingerprint() {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, errNotFound
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return entry.keypair, nil
+}
+
+func (c *MemCertCache) SetKeyPair(host string, certBytes, keyBytes []byte) error {
+	if !c.ca.issued(certBytes) {
+		return errStaleCA
+	}
+	keypair, err := parseKeyPair(certBytes, keyBytes)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.keypairs[host] = &memEntry{keypair: keypair, caFingerprint: c.ca.Fingerprint()}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *MemCertCache) List() ([]*Entry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := make([]*Entry, 0, len(c.keypairs))
+	for host, entry := range c.keypairs {
+		entries = append(entries, &Entry{
+			Host:          host,
+			Cert:          entry.keypair.Leaf,
+			CAFingerprint: entry.caFingerprint,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Host < entries[j].Host
+	})
+	return entries, nil
+}
+
+func (c *MemCertCache) Delete(host string) error {
+	c.mu.Lock()
+	delete(c.keypairs, host)
+	c.mu.Unlock()
+	return nil
+}
+
+// SetCA switches to a new CA, the certs issued by the old one become misses
+func (c *MemCertCache) SetCA(cacert *key.Certificate) {
+	c.ca.Store(cacert)
+}
+
+func (c *MemCertCache) Stats() CacheStats {
+	c.mu.RLock()
+	size := len(c.keypairs)
+	c.mu.RUnlock()
+
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+		Size:   size,
+	}
+}
+
+func (c *MemCertCache) Close() error {
+	return nil
+}
@@ -5,118 +5,139 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 	"xiaolongbaoproxy/pkg/key"
-
-	bolt "go.etcd.io/bbolt"
 )
 
-const (
-	CABUCKET   = "MITMCA"
-	ROOTCACERT = "MITMROOTCACERT"
-	ROOTCAKEY  = "MITMROOTCAKEY"
-	CERTBUCKET = "MITMCERT"
-	KEYBUCKET  = "MITMKEY"
-)
+// CertCache stores the leaf key pairs issued by the mitm proxy
+type CertCache interface {
+	// GetKeyPair returns a valid key pair for host, or an error if there is none
+	GetKeyPair(host string) (*tls.Certificate, error)
+	// SetKeyPair stores the DER encoded cert and PEM encoded key for host
+	SetKeyPair(host string, certBytes, keyBytes []byte) error
+	// List returns all the entries, including the expired ones
+	List() ([]*Entry, error)
+	// Delete removes the entry of host
+	Delete(host string) error
+	// SetCA switches to a new CA, the certs issued by the old one become misses
+	SetCA(cacert *key.Certificate)
+	// Stats returns the hit/miss counters of the cache
+	Stats() CacheStats
+	// Close releases the resources held by the cache
+	Close() error
+}
 
-type CertCache struct {
-	Db *bolt.DB
+// Entry describes one cached leaf certificate
+type Entry struct {
+	Host string
+	// Cert is nil if the stored certificate can not be parsed
+	Cert *x509.Certificate
+	// CAFingerprint is the sha256 fingerprint of the CA which issued the cert
+	CAFingerprint string
 }
 
-func sliceEqual(a, b []byte) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i, v := range a {
-		if v != b[i] {
-			return false
-		}
-	}
-	return true
+// Expired tells whether the entry can not be served any more
+func (e *Entry) Expired() bool {
+	return e.Cert == nil || e.Cert.NotAfter.Before(time.Now())
 }
 
-func NewCertCache(cachepath string, cacert *key.Certificate, cakey *key.PrivateKey) (*CertCache, error) {
-	db, err := bolt.Open(cachepath, 0666, nil)
-	if err != nil {
-		return nil, err
-	}
+// CacheStats is a snapshot of the cache counters, a hit is a key pair
+// served from memory or read from the store, Size counts the in-memory ones
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	Size   int
+}
 
-	// reset cache store if ca cert has changed
-	err = db.Update(func(t *bolt.Tx) error {
-		b, err := t.CreateBucketIfNotExists([]byte(CABUCKET))
-		if err != nil {
-			return err
-		}
+// RENEWBEFORE is how long before `not after` a leaf is considered a miss,
+// so it gets renewed before clients start to reject it
+const RENEWBEFORE = 24 * time.Hour
 
-		cacheCaCert := b.Get([]byte(ROOTCACERT))
-		cacheCaKey := b.Get([]byte(ROOTCAKEY))
-		if !sliceEqual(cacheCaCert, cacert.PEMEncoded()) || !sliceEqual(cacheCaKey, cakey.PEMEncoded()) {
-			err := b.Put([]byte(ROOTCACERT), []byte(cacert.PEMEncoded()))
-			if err != nil {
-				return err
-			}
-			err = b.Put([]byte(ROOTCAKEY), []byte(cakey.PEMEncoded()))
-			if err != nil {
-				return err
-			}
-
-			// remove other buckets as root ca is changed
-			t.DeleteBucket([]byte(CERTBUCKET))
-			t.DeleteBucket([]byte(KEYBUCKET))
-		}
+var (
+	errNotFound  = errors.New("cert/key not found")
+	errStaleCA   = errors.New("the cert is issued by another CA")
+	errExpiresIn = errors.New("the cert's `not after` is within the renewal window")
+)
 
-		_, err = t.CreateBucketIfNotExists([]byte(CERTBUCKET))
-		if err != nil {
-			return err
-		}
+const (
+	MEMSCHEME  = "mem://"
+	DIRSCHEME  = "dir://"
+	BOLTSCHEME = "bolt://"
+)
 
-		_, err = t.CreateBucketIfNotExists([]byte(KEYBUCKET))
-		if err != nil {
-			return err
-		}
-		return nil
-	})
+// NewCertCache opens the cache described by uri, one of
+//
+//	mem://            in-memory, lost on exit
+//	dir:///path       a directory of PEM files, can be shared between proxies
+//	bolt:///path      a bbolt database
+//
+// a uri without scheme is the path of a bbolt database.
+func NewCertCache(uri string, cacert *key.Certificate) (CertCache, error) {
+	switch {
+	case strings.HasPrefix(uri, MEMSCHEME):
+		return NewMemCertCache(cacert), nil
+	case strings.HasPrefix(uri, DIRSCHEME):
+		return NewDirCertCache(strings.TrimPrefix(uri, DIRSCHEME), cacert)
+	case strings.HasPrefix(uri, BOLTSCHEME):
+		return NewBoltCertCache(strings.TrimPrefix(uri, BOLTSCHEME), cacert)
+	case strings.Contains(uri, "://"):
+		return nil, fmt.Errorf("unknown cert cache scheme: %v", uri)
+	default:
+		return NewBoltCertCache(uri, cacert)
+	}
+}
 
+// IssueKeyPair signs a leaf certificate for host with the CA and stores it in the cache
+func IssueKeyPair(c CertCache, host string, leaf *key.PrivateKey, cakey *key.PrivateKey, cacert *key.Certificate) (*tls.Certificate, error) {
+	signedcert, signedkey, err := key.CertificateForPrivateKey(host, leaf, cakey, cacert)
 	if err != nil {
 		return nil, err
 	}
 
-	certCache := &CertCache{
-		Db: db,
+	keypair, err := tls.X509KeyPair(signedcert.PEMEncoded(), signedkey.PEMEncoded())
+	if err != nil {
+		return nil, err
 	}
+	keypair.Leaf = signedcert.Cert
 
-	return certCache, nil
+	if err := c.SetKeyPair(host, signedcert.DerBytes, signedkey.PEMEncoded()); err != nil {
+		// the key pair is still usable, it is just not cached
+		return &keypair, fmt.Errorf("store the key pair failed: %v", err)
+	}
+	return &keypair, nil
 }
 
-func (c *CertCache) GetKeyPair(host string) (*tls.Certificate, error) {
-	var certDerBytes []byte
-	var keyBytes []byte
-	err := c.Db.Update(func(t *bolt.Tx) error {
-		certBucket := t.Bucket([]byte(CERTBUCKET))
-		certDerBytes = certBucket.Get([]byte(host))
-
-		keyBucket := t.Bucket([]byte(KEYBUCKET))
-		keyBytes = keyBucket.Get([]byte(host))
-
-		if certDerBytes == nil || keyBytes == nil {
-			return errors.New("cert/key not found")
-		}
-
-		return nil
-	})
-
+// PurgeExpired removes the expired entries and returns how many were removed
+func PurgeExpired(c CertCache) (int, error) {
+	entries, err := c.List()
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if !e.Expired() {
+			continue
+		}
+		if err := c.Delete(e.Host); err != nil {
+			return n, err
+		}
+		n++
 	}
+	return n, nil
+}
 
+// parseKeyPair builds a key pair from the stored DER cert and PEM key,
+// and rejects certs which are no longer valid
+func parseKeyPair(certDerBytes, keyBytes []byte) (*tls.Certificate, error) {
 	// check cert `not after` time is valid
 	cert, err := x509.ParseCertificate(certDerBytes)
 	if err != nil {
 		return nil, fmt.Errorf("parse certificate error: %v", err)
 	}
-	// the cert from cache's time is invalid
-	if cert.NotAfter.Before(time.Now()) {
-		return nil, errors.New("the cert's `not after` is before now")
+	// the cert from cache's time is invalid, or will be soon
+	if needsRenewal(cert) {
+		return nil, errExpiresIn
 	}
 
 	wrappedCert := &key.Certificate{Cert: cert, DerBytes: certDerBytes}
@@ -125,31 +146,16 @@ func (c *CertCache) GetKeyPair(host string) (*tls.Certificate, error) {
 	if err != nil {
 		return nil, err
 	}
+	keypair.Leaf = cert
 
-	return &keypair, err
+	return &keypair, nil
 }
 
-func (c *CertCache) SetKeyPair(host string, certBytes, keyBytes []byte) error {
-
-	err := c.Db.Update(func(t *bolt.Tx) error {
-		certBucket := t.Bucket([]byte(CERTBUCKET))
-		err := certBucket.Put([]byte(host), certBytes)
-		if err != nil {
-			return err
-		}
-
-		keyBucket := t.Bucket([]byte(KEYBUCKET))
-		err = keyBucket.Put([]byte(host), keyBytes)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		return err
-	}
+func needsRenewal(cert *x509.Certificate) bool {
+	return cert.NotAfter.Before(time.Now().Add(RENEWBEFORE))
+}
 
-	return nil
+// validLeaf tells whether a parsed key pair can still be served
+func validLeaf(keypair *tls.Certificate) bool {
+	return keypair.Leaf != nil && !needsRenewal(keypair.Leaf)
 }
@@ -0,0 +1,56 @@
+package keycache
+
+import (
+	"sync"
+	"time"
+)
+
+// SWEEPINTERVAL is how often the expired entries are removed
+const SWEEPINTERVAL = time.Hour
+
+// Sweeper removes the expired entries of a cache in the background
+type Sweeper struct {
+	cache    CertCache
+	quit     chan struct{}
+	quitOnce sync.Once
+	done     chan struct{}
+}
+
+// StartSweeper purges the expired entries of c every interval
+func StartSweeper(c CertCache, interval time.Duration) *Sweeper {
+	s := &Sweeper{
+		cache: c,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+func (s *Sweeper) run(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := PurgeExpired(s.cache)
+			if err != nil {
+				logger().Errorf("[keycache] sweep expired certs failed: %v", err)
+			} else if n > 0 {
+				logger().Infof("[keycache] swept %v expired certs", n)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Stop stops the sweeper and waits for a running sweep to finish
+func (s *Sweeper) Stop() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+	<-s.done
+}
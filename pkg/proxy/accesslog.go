@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	ACCESSLOGCOMMON   = "common"
+	ACCESSLOGCOMBINED = "combined"
+	ACCESSLOGJSON     = "json"
+	ACCESSLOGLOGFMT   = "logfmt"
+)
+
+// CLFTIMEFORMAT is the time format of the common log format
+const CLFTIMEFORMAT = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogConfig describes where and how the access log is written
+type AccessLogConfig struct {
+	// Format is common, combined, json or logfmt
+	Format string `json:"format" yaml:"format"`
+	// File is the log file, - for stdout
+	File string `json:"file" yaml:"file"`
+	// MaxSize is the size in megabytes which rotates the file, 0 for 100
+	MaxSize int `json:"max_size" yaml:"max_size"`
+	// MaxBackups is how many rotated files are kept, 0 keeps them all
+	MaxBackups int `json:"max_backups" yaml:"max_backups"`
+	// MaxAge is how many days rotated files are kept, 0 keeps them all
+	MaxAge   int  `json:"max_age" yaml:"max_age"`
+	Compress bool `json:"compress" yaml:"compress"`
+}
+
+// AccessLog writes a line per request reported to the hook, apart from the
+// diagnostic log
+type AccessLog struct {
+	mu     sync.Mutex
+	format string
+	w      io.Writer
+}
+
+// NewAccessLog opens the access log, the file is rotated by size
+func NewAccessLog(cfg *AccessLogConfig) (*AccessLog, error) {
+	// cfg may be shared with a reload, it is left as given
+	format := cfg.Format
+	switch format {
+	case "":
+		format = ACCESSLOGCOMMON
+	case ACCESSLOGCOMMON, ACCESSLOGCOMBINED, ACCESSLOGJSON, ACCESSLOGLOGFMT:
+	default:
+		return nil, fmt.Errorf("unknown access log format: %v", format)
+	}
+
+	l := &AccessLog{format: format}
+	if cfg.File == "-" {
+		l.w = os.Stdout
+		return l, nil
+	}
+	// fail now rather than at the first request
+	f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	l.w = &lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+		LocalTime:  true,
+	}
+	return l, nil
+}
+
+// Close closes the log file
+func (l *AccessLog) Close() error {
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// accessEntry are the fields of an access log line
+type accessEntry struct {
+	Time          string  `json:"time"`
+	Session       int64   `json:"session"`
+	Conn          int64   `json:"conn"`
+	Client        string  `json:"client"`
+	User          string  `json:"user"`
+	Method        string  `json:"method"`
+	Url           string  `json:"url"`
+	Proto         string  `json:"proto"`
+	Status        int     `json:"status"`
+	RequestBytes  int64   `json:"request_bytes"`
+	ResponseBytes int64   `json:"response_bytes"`
+	Duration      float64 `json:"duration_ms"`
+	Mitm          bool    `json:"mitm"`
+	Upstream      string  `json:"upstream"`
+	Error         string  `json:"error"`
+	Referer       string  `json:"referer"`
+	UserAgent     string  `json:"user_agent"`
+}
+
+func newAccessEntry(ctx *ProxyCtx) *accessEntry {
+	e := &accessEntry{
+		Time:          ctx.Timing.Received.Format(time.RFC3339Nano),
+		Session:       ctx.Session,
+		Conn:          ctx.Conn.Id,
+		Client:        ctx.Conn.ClientAddr,
+		User:          ctx.Conn.ProxyUser,
+		Method:        ctx.Request.Method,
+		Url:           ctx.Request.Url,
+		Proto:         ctx.Request.Proto,
+		Status:        ctx.Response.StatusCode,
+		RequestBytes:  ctx.Request.Bytes.Wire,
+		ResponseBytes: ctx.TransferBytes,
+		Duration:      float64(ctx.Timing.Total().Microseconds()) / 1000,
+		Mitm:          ctx.Conn.Mitm,
+		Upstream:      ctx.UpstreamAddr,
+	}
+	if ctx.Error != nil {
+		e.Error = string(ctx.Error.Kind)
+	}
+	switch {
+	case ctx.Request.Method == "CONNECT":
+		e.Url = ctx.Conn.Target
+	case strings.HasPrefix(e.Url, "/"):
+		// requests in a tunnel use the origin form
+		scheme := "http://"
+		if ctx.Request.Tls {
+			scheme = "https://"
+		}
+		e.Url = scheme + ctx.Request.Host + e.Url
+	}
+	if h := ctx.Request.Headers; h != nil {
+		e.Referer = firstHeader(h, "Referer")
+		e.UserAgent = firstHeader(h, "User-Agent")
+	}
+	return e
+}
+
+func firstHeader(h map[string][]string, key string) string {
+	if vs := h[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// dash is the common log format placeholder for missing values
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Log writes the line of a request
+func (l *AccessLog) Log(ctx *ProxyCtx) {
+	e := newAccessEntry(ctx)
+	var line string
+	switch l.format {
+	case ACCESSLOGJSON:
+		data, _ := json.Marshal(e)
+		line = string(data)
+	case ACCESSLOGLOGFMT:
+		line = e.logfmt()
+	default:
+		line = e.clf(ctx, l.format == ACCESSLOGCOMBINED)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line+"\n")
+}
+
+// clf is the common, or combined, log format followed by the session, the
+// duration in milliseconds and whether the request was intercepted
+func (e *accessEntry) clf(ctx *ProxyCtx, combined bool) string {
+	client := e.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	size := "-"
+	if e.ResponseBytes > 0 {
+		size = strconv.FormatInt(e.ResponseBytes, 10)
+	}
+	line := fmt.Sprintf("%v - %v [%v] %q %v %v", dash(client), dash(e.User),
+		ctx.Timing.Received.Format(CLFTIMEFORMAT), e.Method+" "+e.Url+" "+e.Proto, e.Status, size)
+	if combined {
+		line += fmt.Sprintf(" %q %q", dash(e.Referer), dash(e.UserAgent))
+	}
+	mitm := "-"
+	if e.Mitm {
+		mitm = "mitm"
+	}
+	return line + fmt.Sprintf(" %v %.3f %v", e.Session, e.Duration, mitm)
+}
+
+func (e *accessEntry) logfmt() string {
+	fields := []struct {
+		key   string
+		value interface{}
+	}{
+		{"time", e.Time}, {"session", e.Session}, {"conn", e.Conn}, {"client", e.Client},
+		{"user", e.User}, {"method", e.Method}, {"url", e.Url}, {"proto", e.Proto},
+		{"status", e.Status}, {"request_bytes", e.RequestBytes}, {"response_bytes", e.ResponseBytes},
+		{"duration_ms", e.Duration}, {"mitm", e.Mitm}, {"upstream", e.Upstream}, {"error", e.Error},
+		{"referer", e.Referer}, {"user_agent", e.UserAgent},
+	}
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		v := fmt.Sprint(f.value)
+		if v == "" || strings.ContainsAny(v, " =\"\\") {
+			v = strconv.Quote(v)
+		}
+		parts = append(parts, f.key+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
+
+// SetAccessLog writes a line per request to l, nil disables the access log
+func (p *ProxyServer) SetAccessLog(l *AccessLog) {
+	p.accessLog = l
+}
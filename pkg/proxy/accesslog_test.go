@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accessLogCtx is a mitm request with every field of the access log set
+func accessLogCtx() *ProxyCtx {
+	received := time.Date(2020, time.March, 4, 5, 6, 7, 0, time.UTC)
+	return &ProxyCtx{
+		Session: 42,
+		Conn: &ProxyConn{
+			Id:         7,
+			ClientAddr: "10.0.0.1:51000",
+			ProxyUser:  "alice",
+			Target:     "example.test:443",
+			Mitm:       true,
+		},
+		Seq:           2,
+		TransferBytes: 1234,
+		Request: &ProxyRequest{
+			Method: "GET",
+			Proto:  "HTTP/1.1",
+			Host:   "example.test",
+			Url:    "/index.html?q=1",
+			Tls:    true,
+			Headers: map[string][]string{
+				"Referer":    {"https://example.test/"},
+				"User-Agent": {"curl/7.68.0"},
+			},
+			Bytes: ProxyBytes{Wire: 96},
+		},
+		Response:     &ProxyResponse{StatusCode: 200},
+		UpstreamAddr: "93.184.216.34:443",
+		Timing:       ProxyTiming{Received: received, Done: received.Add(1500 * time.Microsecond)},
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+	}{
+		{ACCESSLOGCOMMON, `10.0.0.1 - alice [04/Mar/2020:05:06:07 +0000] "GET https://example.test/index.html?q=1 HTTP/1.1" 200 1234 42 1.500 mitm`},
+		{ACCESSLOGCOMBINED, `10.0.0.1 - alice [04/Mar/2020:05:06:07 +0000] "GET https://example.test/index.html?q=1 HTTP/1.1" 200 1234 "https://example.test/" "curl/7.68.0" 42 1.500 mitm`},
+		{ACCESSLOGJSON, `{"time":"2020-03-04T05:06:07Z","session":42,"conn":7,"client":"10.0.0.1:51000","user":"alice","method":"GET","url":"https://example.test/index.html?q=1","proto":"HTTP/1.1","status":200,"request_bytes":96,"response_bytes":1234,"duration_ms":1.5,"mitm":true,"upstream":"93.184.216.34:443","error":"","referer":"https://example.test/","user_agent":"curl/7.68.0"}`},
+		{ACCESSLOGLOGFMT, `time=2020-03-04T05:06:07Z session=42 conn=7 client=10.0.0.1:51000 user=alice method=GET url="https://example.test/index.html?q=1" proto=HTTP/1.1 status=200 request_bytes=96 response_bytes=1234 duration_ms=1.5 mitm=true upstream=93.184.216.34:443 error="" referer=https://example.test/ user_agent=curl/7.68.0`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := &AccessLog{format: tt.format, w: &buf}
+			l.Log(accessLogCtx())
+			if got := buf.String(); got != tt.line+"\n" {
+				t.Errorf("got  %v\nwant %v", got, tt.line)
+			}
+		})
+	}
+}
+
+func TestAccessLogFailedConnect(t *testing.T) {
+	ctx := accessLogCtx()
+	ctx.Conn.ProxyUser, ctx.Conn.Mitm = "", false
+	ctx.Request.Method, ctx.Request.Url = "CONNECT", "example.test:443"
+	ctx.Request.Headers = nil
+	ctx.Response.StatusCode = 502
+	ctx.TransferBytes = 0
+	ctx.Error = &ProxyError{Kind: ERRCONNECT}
+
+	var buf bytes.Buffer
+	l := &AccessLog{format: ACCESSLOGCOMBINED, w: &buf}
+	l.Log(ctx)
+	want := `10.0.0.1 - - [04/Mar/2020:05:06:07 +0000] "CONNECT example.test:443 HTTP/1.1" 502 - "-" "-" 42 1.500 -` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+
+	buf.Reset()
+	l.format = ACCESSLOGLOGFMT
+	l.Log(ctx)
+	if !strings.Contains(buf.String(), " error="+string(ERRCONNECT)+" ") {
+		t.Errorf("no error in %v", buf.String())
+	}
+}
+
+func TestNewAccessLog(t *testing.T) {
+	dir := newTempDir(t)
+	if _, err := NewAccessLog(&AccessLogConfig{File: "-", Format: "xml"}); err == nil {
+		t.Error("an unknown format is accepted")
+	}
+	if _, err := NewAccessLog(&AccessLogConfig{File: filepath.Join(dir, "missing", "access.log")}); err == nil {
+		t.Error("a file in a missing directory is accepted")
+	}
+
+	file := filepath.Join(dir, "access.log")
+	cfg := &AccessLogConfig{File: file}
+	l, err := NewAccessLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cfg != (AccessLogConfig{File: file}) {
+		t.Errorf("the config was changed to %+v", *cfg)
+	}
+	l.Log(accessLogCtx())
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the common format by default
+	if !strings.HasPrefix(string(data), "10.0.0.1 - alice [") {
+		t.Errorf("unexpected line %q", data)
+	}
+}
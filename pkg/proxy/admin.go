@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// AdminHandler serves the admin API, it should only be exposed on a
+// separate, trusted listener
+//
+//	POST /ca/reload   reload the CA from its files
+//	GET  /metrics     prometheus metrics
+func (p *ProxyServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ca/reload", p.handleReloadCA)
+	mux.Handle("/metrics", p.metrics.handler())
+	return mux
+}
+
+func (p *ProxyServer) handleReloadCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.Mitm {
+		http.Error(w, "not a mitm proxy", http.StatusBadRequest)
+		return
+	}
+	if err := p.ReloadCA(); err != nil {
+		p.logger().Errorf("[admin] reload CA failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cert, _ := p.CA()
+	fmt.Fprintf(w, "reloaded CA %v\n", cert.Fingerprint())
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// ProxyBytes counts the bytes of a request or a response
+type ProxyBytes struct {
+	// Headers is the size of the start line and the header block
+	Headers int64
+	// Body is the decoded body, without the chunked framing
+	Body int64
+	// Wire is what went over the upstream connection, framing included and
+	// tls excluded. It falls back to Headers + Body when the connection is
+	// not observable, e.g. a custom Tr. For a tunnel only Wire is known.
+	Wire int64
+}
+
+// countingConn counts the bytes read and written on a connection
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Counts returns the bytes read and written so far
+func (c *countingConn) Counts() (int64, int64) {
+	return atomic.LoadInt64(&c.read), atomic.LoadInt64(&c.written)
+}
+
+// countingReader counts the bytes read from a body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReader) Count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
+
+// countRequestBody wraps the body of r, an empty body is kept as is so the
+// transport does not switch to chunked encoding
+func countRequestBody(r *http.Request) *countingReader {
+	body := &countingReader{}
+	if r.Body != nil && r.Body != http.NoBody {
+		body.ReadCloser = r.Body
+		r.Body = body
+	}
+	return body
+}
+
+func headerSize(h http.Header) int64 {
+	var n int64
+	for k, vs := range h {
+		for _, v := range vs {
+			n += int64(len(k) + len(": ") + len(v) + len("\r\n"))
+		}
+	}
+	return n + int64(len("\r\n"))
+}
+
+// requestHeaderSize is the size of the request head as sent by the client
+func requestHeaderSize(r *http.Request) int64 {
+	n := int64(len(r.Method) + len(" ") + len(r.RequestURI) + len(" ") + len(r.Proto) + len("\r\n"))
+	if r.Host != "" {
+		n += int64(len("Host: ") + len(r.Host) + len("\r\n"))
+	}
+	return n + headerSize(r.Header)
+}
+
+// responseHeaderSize is the size of the response head as sent by the upstream
+func responseHeaderSize(res *http.Response) int64 {
+	return int64(len(res.Proto)+len(" ")+len(res.Status)+len("\r\n")) + headerSize(res.Header)
+}
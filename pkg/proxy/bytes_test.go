@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHeaderSizes(t *testing.T) {
+	reqHead := "POST http://example.com/upload?x=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nX-Test: a\r\nX-Test: b\r\n\r\n"
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(reqHead + "ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := requestHeaderSize(r); got != int64(len(reqHead)) {
+		t.Errorf("requestHeaderSize = %v, want %v", got, len(reqHead))
+	}
+
+	resHead := "HTTP/1.1 404 Not Found\r\nContent-Length: 2\r\nContent-Type: text/plain\r\n\r\n"
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(resHead+"no")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := responseHeaderSize(res); got != int64(len(resHead)) {
+		t.Errorf("responseHeaderSize = %v, want %v", got, len(resHead))
+	}
+}
+
+func TestPlainProxyBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		io.WriteString(w, "hello world")
+	}))
+	defer upstream.Close()
+
+	ctxs := make(chan *ProxyCtx, 1)
+	proxySrv := httptest.NewServer(NewProxyServer(func(ctx *ProxyCtx) { ctxs <- ctx }))
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	res, err := client.Post(upstream.URL+"/upload", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	ctx := <-ctxs
+	req, resp := ctx.Request.Bytes, ctx.Response.Bytes
+	if req.Body != 4 || resp.Body != 11 {
+		t.Errorf("body bytes: request %v, response %v", req.Body, resp.Body)
+	}
+	// the head sent upstream differs from the one received, only the
+	// wire includes it as is
+	if req.Headers == 0 || req.Wire <= req.Body {
+		t.Errorf("request bytes %+v", req)
+	}
+	if resp.Headers == 0 || resp.Wire <= resp.Body {
+		t.Errorf("response bytes %+v", resp)
+	}
+	if ctx.TransferBytes != resp.Body {
+		t.Errorf("TransferBytes = %v, want %v", ctx.TransferBytes, resp.Body)
+	}
+}
+
+func TestMitmProxyBytes(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctxs := make(chan *ProxyCtx, 1)
+	p.Hook = func(ctx *ProxyCtx) { ctxs <- ctx }
+
+	if res, body := mitmGet(t, p, ca, strings.TrimPrefix(upstream.URL, "https://")); res.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("got %v %q", res.Status, body)
+	}
+	ctx := <-ctxs
+	req, resp := ctx.Request.Bytes, ctx.Response.Bytes
+	if req.Body != 0 || req.Headers == 0 || req.Wire == 0 {
+		t.Errorf("request bytes %+v", req)
+	}
+	if resp.Body != 2 || resp.Headers == 0 || resp.Wire <= resp.Body {
+		t.Errorf("response bytes %+v", resp)
+	}
+}
+
+func TestTunnelBytes(t *testing.T) {
+	echo := startEchoServer(t)
+	ctxs := make(chan *ProxyCtx, 1)
+	conn := dialProxy(t, NewProxyServer(func(ctx *ProxyCtx) { ctxs <- ctx }))
+	if _, err := io.WriteString(conn, connectRequest(echo)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	readConnectResponse(t, r)
+
+	payload := "some opaque bytes"
+	io.WriteString(conn, payload)
+	if _, err := io.ReadFull(r, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	ctx := <-ctxs
+	n := int64(len(payload))
+	if ctx.Request.Bytes.Wire != n || ctx.Response.Bytes.Wire != n || ctx.TransferBytes != n {
+		t.Errorf("tunnel bytes: up %+v, down %+v, transfer %v", ctx.Request.Bytes, ctx.Response.Bytes, ctx.TransferBytes)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+	"xiaolongbaoproxy/pkg/key"
+)
+
+// caPair is the CA used to issue leaf certificates, it is swapped as a
+// whole so a leaf is never signed by a cert and key from different CAs
+type caPair struct {
+	cert *key.Certificate
+	pk   *key.PrivateKey
+}
+
+func loadCA(certpath, pkpath string) (*key.Certificate, *key.PrivateKey, error) {
+	cert, err := key.LoadCertificateFromFile(certpath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read cert failed: %v", err)
+	}
+	pk, err := key.LoadPKFromFile(pkpath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read key failed: %v", err)
+	}
+	if err := key.ValidateCA(cert, pk); err != nil {
+		return nil, nil, err
+	}
+	return cert, pk, nil
+}
+
+// CA returns the CA certificate and private key currently used for new connections
+func (p *ProxyServer) CA() (*key.Certificate, *key.PrivateKey) {
+	ca := p.ca.Load().(*caPair)
+	return ca.cert, ca.pk
+}
+
+// SetCA validates and switches to a new CA. New connections are served
+// with leaves issued by it, established tunnels keep their certificate.
+func (p *ProxyServer) SetCA(cert *key.Certificate, pk *key.PrivateKey) error {
+	if err := key.ValidateCA(cert, pk); err != nil {
+		return err
+	}
+	p.settingsMu.Lock()
+	defer p.settingsMu.Unlock()
+	p.switchCA(cert, pk)
+	return nil
+}
+
+// switchCA switches to a validated CA, settingsMu must be held so a reload
+// does not interleave with another one
+func (p *ProxyServer) switchCA(cert *key.Certificate, pk *key.PrivateKey) {
+	if cert.Cert.NotAfter.Before(time.Now()) {
+		p.tlsLogger().Warnf("[tls] the CA certificate expired at %v", cert.Cert.NotAfter)
+	}
+	if !cert.Cert.IsCA {
+		p.tlsLogger().Warnf("[tls] the CA certificate is not marked as a CA, clients may reject the leaves")
+	}
+
+	p.ca.Store(&caPair{cert: cert, pk: pk})
+	if p.certCache != nil {
+		p.certCache.SetCA(cert)
+	}
+	p.tlsLogger().Infof("[tls] switched to CA %v, fingerprint %v", cert.Cert.Subject, cert.Fingerprint())
+}
+
+// ReloadCA reads the CA from the files the proxy was started with and switches to it
+func (p *ProxyServer) ReloadCA() error {
+	p.settingsMu.Lock()
+	defer p.settingsMu.Unlock()
+	cert, pk, err := loadCA(p.caCertPath, p.caKeyPath)
+	if err != nil {
+		return err
+	}
+	p.switchCA(cert, pk)
+	return nil
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadCA(t *testing.T) {
+	p, oldCert := newFileCAMitmServer(t)
+	admin := httptest.NewServer(p.AdminHandler())
+	defer admin.Close()
+
+	keypair, err := p.getKeyPair(NewProxyCtx(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keypair.Leaf.CheckSignatureFrom(oldCert.Cert); err != nil {
+		t.Fatalf("the leaf is not issued by the CA: %v", err)
+	}
+
+	// a key of another CA is rejected and the CA is kept
+	_, otherPk := newTestCA(t)
+	writeTestCA(t, filepath.Dir(p.caCertPath), oldCert.PEMEncoded(), otherPk.PEMEncoded())
+	if res := postReload(t, admin.URL); res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("a mismatched CA reload returned %v", res.Status)
+	}
+	if cert, _ := p.CA(); cert.Fingerprint() != oldCert.Fingerprint() {
+		t.Fatal("a failed reload changed the CA")
+	}
+
+	newCert, newPk := newTestCA(t)
+	writeTestCA(t, filepath.Dir(p.caCertPath), newCert.PEMEncoded(), newPk.PEMEncoded())
+	if res := postReload(t, admin.URL); res.StatusCode != http.StatusOK {
+		t.Fatalf("reload returned %v", res.Status)
+	}
+	if cert, _ := p.CA(); cert.Fingerprint() != newCert.Fingerprint() {
+		t.Fatal("the reload did not switch the CA")
+	}
+	keypair, err = p.getKeyPair(NewProxyCtx(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keypair.Leaf.CheckSignatureFrom(newCert.Cert); err != nil {
+		t.Fatalf("the leaf is not issued by the new CA: %v", err)
+	}
+}
+
+func TestAdminReloadMethod(t *testing.T) {
+	p, _, _ := newTestMitmServer(t)
+	admin := httptest.NewServer(p.AdminHandler())
+	defer admin.Close()
+
+	res, err := http.Get(admin.URL + "/ca/reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET returned %v", res.Status)
+	}
+}
+
+func postReload(t *testing.T, url string) *http.Response {
+	t.Helper()
+	res, err := http.Post(url+"/ca/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	MODEBASIC = "basic"
+	MODEMITM  = "mitm"
+)
+
+// Config describes a proxy server as a whole, it is what the config file is
+// read into
+type Config struct {
+	// Listen are the addresses the proxy accepts clients on
+	Listen []string `json:"listen" yaml:"listen"`
+	// Mode is basic or mitm
+	Mode string `json:"mode" yaml:"mode"`
+	// Admin is the address of the admin API, empty to disable it
+	Admin string `json:"admin" yaml:"admin"`
+	// ShutdownTimeout is how long the tunnels are drained on shutdown
+	ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+
+	CA         CAConfig         `json:"ca" yaml:"ca"`
+	Cache      CacheConfig      `json:"cache" yaml:"cache"`
+	Tls        TlsPolicy        `json:"tls" yaml:"tls"`
+	Upstream   UpstreamTls      `json:"upstream" yaml:"upstream"`
+	Rules      MitmRules        `json:"rules" yaml:"rules"`
+	AutoTunnel AutoTunnelConfig `json:"auto_tunnel" yaml:"auto_tunnel"`
+	Hooks      HooksConfig      `json:"hooks" yaml:"hooks"`
+	AccessLog  AccessLogConfig  `json:"access_log" yaml:"access_log"`
+	Tracing    TracingConfig    `json:"tracing" yaml:"tracing"`
+}
+
+// CAConfig is the CA issuing the leaf certificates
+type CAConfig struct {
+	Cert string `json:"cert" yaml:"cert"`
+	Key  string `json:"key" yaml:"key"`
+}
+
+// CacheConfig is where the leaf certificates are kept
+type CacheConfig struct {
+	// Store is a bbolt path, bolt:///path, dir:///path or mem://
+	Store string `json:"store" yaml:"store"`
+	// KeyPool is the number of pre-generated leaf keys, 0 to disable it
+	KeyPool int `json:"key_pool" yaml:"key_pool"`
+}
+
+// AutoTunnelConfig tunnels a host once its clients rejected the forged
+// certificate After times, 0 disables it
+type AutoTunnelConfig struct {
+	After int      `json:"after" yaml:"after"`
+	TTL   Duration `json:"ttl" yaml:"ttl"`
+}
+
+// HooksConfig selects the hooks shipped with the proxy
+type HooksConfig struct {
+	// Record logs every request and connection at debug level
+	Record bool `json:"record" yaml:"record"`
+}
+
+// TracingConfig exports the spans to an otlp/http collector, an empty
+// endpoint disables tracing
+type TracingConfig struct {
+	Endpoint string  `json:"endpoint" yaml:"endpoint"`
+	Insecure bool    `json:"insecure" yaml:"insecure"`
+	Ratio    float64 `json:"ratio" yaml:"ratio"`
+}
+
+// Duration is a time.Duration written as 90s or 10m in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalYAML is needed as yaml.v2 ignores UnmarshalText
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// DefaultConfig is the config of the flags left to their defaults
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:          []string{"0.0.0.0:8080"},
+		Mode:            MODEMITM,
+		ShutdownTimeout: Duration(SHUTDOWNTIMEOUT),
+		CA:              CAConfig{Cert: "root.crt", Key: "root.key"},
+		Cache:           CacheConfig{Store: "certstore.db"},
+		Tls:             *DefaultTlsPolicy(),
+		AutoTunnel: AutoTunnelConfig{
+			After: PASSTHROUGHTHRESHOLD,
+			TTL:   Duration(PASSTHROUGHTTL),
+		},
+		AccessLog: AccessLogConfig{
+			Format:     ACCESSLOGCOMMON,
+			MaxSize:    100,
+			MaxBackups: 7,
+		},
+		Tracing: TracingConfig{Ratio: 1},
+	}
+}
+
+// ConfigError lists every problem found in a config
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+// Validate checks the whole config, the files it refers to are read, so an
+// error shows up at startup rather than at the first request
+func (c *Config) Validate() error {
+	var errs ConfigError
+	fail := func(field string, err interface{}) {
+		errs = append(errs, fmt.Sprintf("%v: %v", field, err))
+	}
+
+	if len(c.Listen) == 0 {
+		fail("listen", "no address")
+	}
+	for _, addr := range c.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			fail("listen", err)
+		}
+	}
+	switch c.Mode {
+	case MODEBASIC, MODEMITM:
+	default:
+		fail("mode", fmt.Sprintf("unknown mode %q, expect basic or mitm", c.Mode))
+	}
+	if c.Admin != "" {
+		if _, _, err := net.SplitHostPort(c.Admin); err != nil {
+			fail("admin", err)
+		}
+	}
+	if c.ShutdownTimeout < 0 {
+		fail("shutdown_timeout", "must not be negative")
+	}
+
+	if c.Mode == MODEMITM {
+		if _, _, err := loadCA(c.CA.Cert, c.CA.Key); err != nil {
+			fail("ca", err)
+		}
+		if c.Cache.Store == "" {
+			fail("cache.store", "no store")
+		}
+		if c.Cache.KeyPool < 0 {
+			fail("cache.key_pool", "must not be negative")
+		}
+		if _, err := c.Tls.Config(); err != nil {
+			fail("tls", err)
+		}
+		if _, err := c.Upstream.build(); err != nil {
+			fail("upstream", err)
+		}
+		if _, err := c.Rules.build(); err != nil {
+			fail("rules", err)
+		}
+		if c.AutoTunnel.After > 0 && c.AutoTunnel.TTL <= 0 {
+			fail("auto_tunnel.ttl", "must be positive")
+		}
+	}
+
+	switch c.AccessLog.Format {
+	case "", ACCESSLOGCOMMON, ACCESSLOGCOMBINED, ACCESSLOGJSON, ACCESSLOGLOGFMT:
+	default:
+		fail("access_log.format", fmt.Sprintf("unknown format %q", c.AccessLog.Format))
+	}
+	if c.Tracing.Ratio < 0 || c.Tracing.Ratio > 1 {
+		fail("tracing.ratio", "must be between 0 and 1")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// String is the config as json, e.g. to log what was loaded
+func (c *Config) String() string {
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// NewProxyServerFromConfig creates the proxy described by a validated
+// config. The access log and the tracing are left to the caller, which owns
+// their lifetime.
+func NewProxyServerFromConfig(c *Config, hook func(*ProxyCtx)) (*ProxyServer, error) {
+	if c.Mode == MODEBASIC {
+		return NewProxyServer(hook), nil
+	}
+
+	p, err := New(WithCAFiles(c.CA.Cert, c.CA.Key), WithCertCacheStore(c.Cache.Store), WithKeyPool(c.Cache.KeyPool), WithHook(hook))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.ApplyConfig(c); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"xiaolongbaoproxy/pkg/keycache"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cert, pk := newTestCA(t)
+	certpath, pkpath := writeTestCA(t, newTempDir(t), cert.PEMEncoded(), pk.PEMEncoded())
+	valid := func() *Config {
+		c := DefaultConfig()
+		c.CA = CAConfig{Cert: certpath, Key: pkpath}
+		c.Cache.Store = keycache.MEMSCHEME
+		return c
+	}
+	tests := []struct {
+		name   string
+		change func(*Config)
+		errs   []string
+	}{
+		{"valid", func(*Config) {}, nil},
+		{"basic needs no CA", func(c *Config) { c.Mode = MODEBASIC; c.CA.Cert = "missing.crt" }, nil},
+		{"listen", func(c *Config) { c.Listen = []string{"8080"} }, []string{"listen: "}},
+		{"no listen", func(c *Config) { c.Listen = nil }, []string{"listen: no address"}},
+		{"mode", func(c *Config) { c.Mode = "socks" }, []string{`mode: unknown mode "socks"`}},
+		{"ca", func(c *Config) { c.CA.Cert = "missing.crt" }, []string{"ca: "}},
+		{"every problem", func(c *Config) {
+			c.Admin = "admin"
+			c.Cache.KeyPool = -1
+			c.AccessLog.Format = "xml"
+			c.Tracing.Ratio = 2
+		}, []string{"admin: ", "cache.key_pool: ", `access_log.format: unknown format "xml"`, "tracing.ratio: "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.change(c)
+			err := c.Validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			cerr, ok := err.(ConfigError)
+			if !ok || len(cerr) != len(tt.errs) {
+				t.Fatalf("got %v, want %v errors", err, len(tt.errs))
+			}
+			for i, prefix := range tt.errs {
+				if !strings.HasPrefix(cerr[i], prefix) {
+					t.Errorf("error %v is %q, want %q", i, cerr[i], prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestDurationText(t *testing.T) {
+	var d Duration
+	if err := d.UnmarshalText([]byte("1m30s")); err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := d.MarshalText(); string(text) != "1m30s" {
+		t.Errorf("MarshalText = %s", text)
+	}
+	if err := d.UnmarshalText([]byte("90")); err == nil {
+		t.Error("a duration without unit is accepted")
+	}
+}
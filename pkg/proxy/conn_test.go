@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connRecorder collects what the hooks of a proxy see
+type connRecorder struct {
+	mu     sync.Mutex
+	ctxs   []*ProxyCtx
+	closed chan *ProxyConn
+}
+
+func newConnRecorder() *connRecorder {
+	return &connRecorder{closed: make(chan *ProxyConn, 10)}
+}
+
+func (r *connRecorder) hook(ctx *ProxyCtx) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ctxs = append(r.ctxs, ctx)
+}
+
+func (r *connRecorder) connHook(conn *ProxyConn) {
+	r.closed <- conn
+}
+
+// waitClosed returns the next conn reported to the ConnHook
+func (r *connRecorder) waitClosed(t *testing.T) *ProxyConn {
+	t.Helper()
+	select {
+	case conn := <-r.closed:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ConnHook was not called")
+		return nil
+	}
+}
+
+// startConfiguredProxy serves p with a server set up by ConfigureServer
+func startConfiguredProxy(t *testing.T, p *ProxyServer) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(p)
+	p.ConfigureServer(srv.Config)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestMitmTunnelRequestsShareTheConn(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	target := strings.TrimPrefix(upstream.URL, "https://")
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	rec := newConnRecorder()
+	p.Hook, p.ConnHook = rec.hook, rec.connHook
+
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("https://" + target + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	tr.CloseIdleConnections()
+
+	conn := rec.waitClosed(t)
+	if conn.Requests() != 3 || !conn.Mitm || conn.Tls == nil || conn.Target != target || conn.End.IsZero() {
+		t.Errorf("closed conn: %v requests, mitm %v, tls %v, target %v, end %v",
+			conn.Requests(), conn.Mitm, conn.Tls != nil, conn.Target, conn.End)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	// the CONNECT itself is not hooked once a request is served
+	if len(rec.ctxs) != 2 {
+		t.Fatalf("%v requests hooked, want 2", len(rec.ctxs))
+	}
+	for i, ctx := range rec.ctxs {
+		if ctx.Conn != conn || ctx.Seq != int64(i+2) || !ctx.Request.Tls {
+			t.Errorf("request %v: conn %v seq %v tls %v", i, ctx.Conn.Id, ctx.Seq, ctx.Request.Tls)
+		}
+	}
+	if rec.ctxs[0].Session == rec.ctxs[1].Session {
+		t.Error("the requests of a tunnel share their session")
+	}
+}
+
+func TestTunnelConnHook(t *testing.T) {
+	echo := startEchoServer(t)
+	rec := newConnRecorder()
+	p := NewProxyServer(rec.hook)
+	p.ConnHook = rec.connHook
+
+	conn := dialProxy(t, p)
+	io.WriteString(conn, connectRequest(echo))
+	conn.Close()
+
+	closed := rec.waitClosed(t)
+	if closed.Requests() != 1 || closed.Mitm || closed.Target != echo {
+		t.Errorf("closed conn: %v requests, mitm %v, target %v", closed.Requests(), closed.Mitm, closed.Target)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.ctxs) != 1 || rec.ctxs[0].Conn != closed || rec.ctxs[0].Seq != 1 {
+		t.Errorf("the CONNECT was not hooked once: %v", len(rec.ctxs))
+	}
+}
+
+func TestKeepAliveRequestsShareTheConn(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+	echo := startEchoServer(t)
+	rec := newConnRecorder()
+	p, err := New(WithHook(rec.hook), WithConnHook(rec.connHook),
+		WithDialer(mapDialer{"example.test:80": upstream.Listener.Addr().String(), "example.test:443": echo}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", startConfiguredProxy(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, path := range []string{"/first", "/second"} {
+		fmt.Fprintf(conn, "GET http://example.test%v HTTP/1.1\r\nHost: example.test\r\n\r\n", path)
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	// then a tunnel on the same connection
+	fmt.Fprint(conn, connectRequest("example.test:443"))
+	readConnectResponse(t, r)
+	conn.Close()
+
+	var closed *ProxyConn
+	select {
+	case closed = <-rec.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ConnHook was not called")
+	}
+	if closed.Requests() != 3 || closed.End.IsZero() || closed.Target != "example.test:443" {
+		t.Errorf("closed conn: %v requests, end %v, target %v", closed.Requests(), closed.End, closed.Target)
+	}
+	select {
+	case c := <-rec.closed:
+		t.Errorf("the ConnHook was called again for %v", c.Id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.ctxs) != 3 {
+		t.Fatalf("%v requests hooked, want 3", len(rec.ctxs))
+	}
+	for i, ctx := range rec.ctxs {
+		if ctx.Conn != closed || ctx.Seq != int64(i+1) {
+			t.Errorf("request %v: conn %v seq %v, want conn %v seq %v", i, ctx.Conn.Id, ctx.Seq, closed.Id, i+1)
+		}
+	}
+}
+
+func TestPlainConnHookOnClose(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	rec := newConnRecorder()
+	p, err := New(WithConnHook(rec.connHook), WithDialer(mapDialer{"example.test:80": upstream.Listener.Addr().String()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := startConfiguredProxy(t, p)
+
+	tr := &http.Transport{Proxy: func(*http.Request) (*url.URL, error) { return url.Parse("http://" + proxyAddr) }}
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://example.test/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	tr.CloseIdleConnections()
+
+	select {
+	case conn := <-rec.closed:
+		if conn.Requests() != 2 || conn.End.IsZero() {
+			t.Errorf("closed conn: %v requests, end %v", conn.Requests(), conn.End)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ConnHook was not called")
+	}
+}
+
+func TestFailedHijackConnHookOnClose(t *testing.T) {
+	rec := newConnRecorder()
+	p := NewProxyServer(rec.hook)
+	p.ConnHook = rec.connHook
+	// the response writer given to the proxy hides the Hijacker
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(struct{ http.ResponseWriter }{w}, r)
+	}))
+	p.ConfigureServer(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, connectRequest("example.test:443"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		t.Fatal("the CONNECT succeeded without hijacking")
+	}
+	// the error response closes the connection
+	conn.Close()
+
+	closed := rec.waitClosed(t)
+	if closed.Requests() != 1 || closed.End.IsZero() {
+		t.Errorf("closed conn: %v requests, end %v", closed.Requests(), closed.End)
+	}
+	select {
+	case c := <-rec.closed:
+		t.Errorf("the ConnHook was called again for %v", c.Id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,34 +1,134 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 var g_sess int64
+var g_conn int64
+
+// ProxyConn is a client connection to the proxy, it carries many requests:
+// the plain http ones sent with keep-alive, and the ones in a CONNECT
+// tunnel. Without ProxyServer.ConfigureServer each plain http request gets
+// its own ProxyConn.
+type ProxyConn struct {
+	Id         int64
+	ClientAddr string
+	// ProxyUser is the user of the Proxy-Authorization, not verified
+	ProxyUser string
+	// Target is the host:port of the CONNECT, empty for plain http
+	Target string
+	// Mitm tells whether the requests in the tunnel are intercepted
+	Mitm bool
+	// Tls is the handshake with the client of an intercepted tunnel
+	Tls   *tls.ConnectionState
+	Start time.Time
+	// End is set when the tunnel is closed, before the ConnHook
+	End      time.Time
+	requests int64
+	// settings are the proxy settings when the tunnel was opened
+	settings *proxySettings
+}
+
+func newProxyConn(clientAddr string) *ProxyConn {
+	return &ProxyConn{
+		Id:         atomic.AddInt64(&g_conn, 1),
+		ClientAddr: clientAddr,
+		Start:      time.Now(),
+	}
+}
+
+// Requests is how many requests the connection carried, the CONNECT included
+func (c *ProxyConn) Requests() int64 {
+	return atomic.LoadInt64(&c.requests)
+}
+
+// newRequest creates the ctx of the next request on the connection
+func (c *ProxyConn) newRequest() *ProxyCtx {
+	return &ProxyCtx{
+		Session:  atomic.AddInt64(&g_sess, 1),
+		Conn:     c,
+		Seq:      atomic.AddInt64(&c.requests, 1),
+		Request:  &ProxyRequest{},
+		Response: &ProxyResponse{},
+		Timing:   ProxyTiming{Received: time.Now()},
+	}
+}
 
 type ProxyCtx struct {
-	Session       int64
+	// Session identifies the request
+	Session int64
+	// Conn is the client connection which carried the request
+	Conn *ProxyConn
+	// Seq is the position of the request on Conn, from 1
+	Seq int64
+	// TransferBytes are the response bytes sent to the client: the body,
+	// or everything from the remote for a tunnel
 	TransferBytes int64
 	Request       *ProxyRequest
 	Response      *ProxyResponse
+	// ClientTls is the tls with the client of an intercepted tunnel
+	ClientTls *TlsInfo
+	// UpstreamTls is the tls with the upstream, with the certificate chain it served
+	UpstreamTls *TlsInfo
+	// UpstreamAddr is the resolved ip:port of the upstream
+	UpstreamAddr string
+	// Error is set when the request failed, nil otherwise
+	Error  *ProxyError
+	Timing ProxyTiming
+
+	// the span of the request, see SetTracerProvider
+	traceCtx context.Context
+	span     trace.Span
+	// tunnel is the ctx of the CONNECT the request is served in, nil for
+	// the CONNECT itself and the plain http requests
+	tunnel *ProxyCtx
 }
 
 type ProxyRequest struct {
+	Method  string
+	Proto   string
 	Host    string
 	Url     string
 	Headers map[string][]string
 	Tls     bool
+	// ClientCertificates are the certificates presented by the client to the mitm proxy
+	ClientCertificates []*x509.Certificate
+	Bytes              ProxyBytes
 }
 
 type ProxyResponse struct {
 	Headers    map[string][]string
 	StatusCode int
+	Bytes      ProxyBytes
 }
 
+// NewProxyCtx creates the ctx of a request on a new connection
 func NewProxyCtx() *ProxyCtx {
-	return &ProxyCtx{
-		Session:  atomic.AddInt64(&g_sess, 1),
-		Request:  &ProxyRequest{},
-		Response: &ProxyResponse{},
-	}
+	return newProxyConn("").newRequest()
+}
+
+// newTunnelRequest creates the ctx of a request served in the tunnel opened
+// by the CONNECT of tunnel. The client handshake belongs to the tunnel.
+func newTunnelRequest(tunnel *ProxyCtx) *ProxyCtx {
+	ctx := tunnel.Conn.newRequest()
+	ctx.tunnel = tunnel
+	ctx.Request.Tls = tunnel.Request.Tls
+	ctx.ClientTls = newTlsInfo(tunnel.Conn.Tls)
+	ctx.traceCtx = tunnel.traceCtx
+	ctx.Timing.ClientTlsStart = tunnel.Timing.ClientTlsStart
+	ctx.Timing.ClientTlsDone = tunnel.Timing.ClientTlsDone
+	return ctx
+}
+
+// fail records the error of the request and returns it classified
+func (ctx *ProxyCtx) fail(phase string, err error) *ProxyError {
+	ctx.Error = newProxyError(phase, err)
+	return ctx.Error
 }
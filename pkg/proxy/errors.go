@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ErrorKind classifies why a proxied request failed
+type ErrorKind string
+
+const (
+	ERRDNS         ErrorKind = "dns"
+	ERRCONNECT     ErrorKind = "connect"
+	ERRTLS         ErrorKind = "tls"
+	ERRPROTOCOL    ErrorKind = "upstream-protocol"
+	ERRCLIENTABORT ErrorKind = "client-abort"
+	ERRTIMEOUT     ErrorKind = "timeout"
+	// ERRINTERNAL is a failure of the proxy itself, not of a peer
+	ERRINTERNAL ErrorKind = "internal"
+)
+
+// the phases of a proxied request where an error can occur
+const (
+	PHASEHIJACK      = "hijack"
+	PHASEDIAL        = "dial"
+	PHASEUPSTREAMTLS = "upstream-tls"
+	PHASECERTIFICATE = "certificate"
+	PHASECLIENTTLS   = "client-tls"
+	PHASEREQUEST     = "request"
+	PHASERESPONSE    = "response"
+	PHASECLIENTWRITE = "client-write"
+	PHASETUNNEL      = "tunnel"
+)
+
+// ProxyError is the failure recorded in the ProxyCtx
+type ProxyError struct {
+	Kind  ErrorKind
+	Phase string
+	Err   error
+}
+
+func newProxyError(phase string, err error) *ProxyError {
+	return &ProxyError{Kind: classifyError(phase, err), Phase: phase, Err: err}
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("%v error during %v: %v", e.Kind, e.Phase, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode is the status answered to the client for the error
+func (e *ProxyError) StatusCode() int {
+	switch e.Kind {
+	case ERRTIMEOUT:
+		return http.StatusGatewayTimeout
+	case ERRINTERNAL:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func classifyError(phase string, err error) ErrorKind {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case errors.As(err, &dnsErr):
+		return ERRDNS
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return ERRTIMEOUT
+	case errors.Is(err, context.Canceled):
+		return ERRCLIENTABORT
+	case isTlsVerifyError(err) || errors.As(err, &recordErr) || errors.As(err, &alertErr):
+		return ERRTLS
+	}
+
+	switch phase {
+	case PHASEDIAL:
+		return ERRCONNECT
+	case PHASEUPSTREAMTLS, PHASECLIENTTLS:
+		return ERRTLS
+	case PHASEREQUEST, PHASERESPONSE, PHASETUNNEL:
+		return ERRPROTOCOL
+	case PHASECLIENTWRITE:
+		return ERRCLIENTABORT
+	default:
+		return ERRINTERNAL
+	}
+}
+
+// roundTripPhase tells where a http.Transport round trip failed
+func roundTripPhase(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial" {
+		return PHASEDIAL
+	}
+	return PHASERESPONSE
+}
+
+// writeErrorResponse answers the client with the status of the error
+func writeErrorResponse(ctx *ProxyCtx, w http.ResponseWriter, host string, perr *ProxyError) {
+	ctx.Response.StatusCode = perr.StatusCode()
+	if perr.Kind == ERRTLS && perr.Phase == PHASEUPSTREAMTLS {
+		writeUpstreamTlsError(w, host, perr.Err)
+		return
+	}
+	w.Header().Set("Connection", "close")
+	http.Error(w, perr.Error(), perr.StatusCode())
+}
+
+// writeHijackedError answers a hijacked CONNECT with a complete response,
+// the ResponseWriter can not be used any more once hijacked
+func writeHijackedError(ctx *ProxyCtx, conn io.Writer, perr *ProxyError) {
+	status := perr.StatusCode()
+	ctx.Response.StatusCode = status
+	body := perr.Error() + "\n"
+	fmt.Fprintf(conn, "HTTP/1.1 %d %v\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%v",
+		status, http.StatusText(status), len(body), body)
+}
+
+// clientWriter remembers whether copying a response failed on the client side
+type clientWriter struct {
+	io.Writer
+	err error
+}
+
+func (cw *clientWriter) Write(b []byte) (int, error) {
+	n, err := cw.Writer.Write(b)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// copyResponse copies the body to the client, a failure is classified by the
+// side which caused it
+func copyResponse(w io.Writer, body io.Reader) (int64, string, error) {
+	cw := &clientWriter{Writer: w}
+	nb, err := io.Copy(cw, body)
+	if err != nil && cw.err != nil {
+		return nb, PHASECLIENTWRITE, err
+	}
+	return nb, PHASERESPONSE, err
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name  string
+		phase string
+		err   error
+		want  ErrorKind
+	}{
+		{"dns", PHASEDIAL, &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x.test"}}, ERRDNS},
+		{"refused", PHASEDIAL, refused, ERRCONNECT},
+		{"dial timeout", PHASEDIAL, &net.OpError{Op: "dial", Err: timeoutError{}}, ERRTIMEOUT},
+		{"deadline", PHASERESPONSE, fmt.Errorf("wrapped: %w", context.DeadlineExceeded), ERRTIMEOUT},
+		{"canceled", PHASERESPONSE, context.Canceled, ERRCLIENTABORT},
+		{"pin", PHASEUPSTREAMTLS, &PinError{Host: "x.test"}, ERRTLS},
+		{"record header", PHASERESPONSE, tls.RecordHeaderError{Msg: "bad record"}, ERRTLS},
+		{"handshake", PHASEUPSTREAMTLS, errors.New("handshake failure"), ERRTLS},
+		{"client tls", PHASECLIENTTLS, io.EOF, ERRTLS},
+		{"malformed response", PHASERESPONSE, errors.New("malformed HTTP response"), ERRPROTOCOL},
+		{"tunnel", PHASETUNNEL, io.ErrUnexpectedEOF, ERRPROTOCOL},
+		{"client write", PHASECLIENTWRITE, errors.New("broken pipe"), ERRCLIENTABORT},
+		{"hijack", PHASEHIJACK, errors.New("not supported"), ERRINTERNAL},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.phase, tt.err); got != tt.want {
+			t.Errorf("%v: classifyError = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTripPhase(t *testing.T) {
+	if phase := roundTripPhase(&net.OpError{Op: "dial", Err: errors.New("refused")}); phase != PHASEDIAL {
+		t.Errorf("a dial error is in phase %v", phase)
+	}
+	if phase := roundTripPhase(&net.DNSError{Name: "x.test"}); phase != PHASEDIAL {
+		t.Errorf("a dns error is in phase %v", phase)
+	}
+	if phase := roundTripPhase(&net.OpError{Op: "read", Err: io.EOF}); phase != PHASERESPONSE {
+		t.Errorf("a read error is in phase %v", phase)
+	}
+}
+
+func TestWriteHijackedError(t *testing.T) {
+	tests := []struct {
+		name   string
+		perr   *ProxyError
+		status int
+	}{
+		{"refused", newProxyError(PHASEDIAL, &net.OpError{Op: "dial", Err: errors.New("connection refused")}), http.StatusBadGateway},
+		{"timeout", newProxyError(PHASEDIAL, &net.OpError{Op: "dial", Err: timeoutError{}}), http.StatusGatewayTimeout},
+		{"internal", newProxyError(PHASECERTIFICATE, errors.New("no key")), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewProxyCtx()
+			var buf bytes.Buffer
+			writeHijackedError(ctx, &buf, tt.perr)
+
+			res, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != tt.status || ctx.Response.StatusCode != tt.status {
+				t.Fatalf("status = %v, recorded %v, want %v", res.StatusCode, ctx.Response.StatusCode, tt.status)
+			}
+			if !res.Close || string(body) != tt.perr.Error()+"\n" {
+				t.Fatalf("unexpected response %+v, body %q", res, body)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%v bytes after the response", buf.Len())
+			}
+		})
+	}
+}
+
+// closedAddr is an address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestConnectToClosedPort(t *testing.T) {
+	for _, mitm := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mitm %v", mitm), func(t *testing.T) {
+			p := NewProxyServer(nil)
+			if mitm {
+				// a tunnelled host is dialed before the CONNECT is answered
+				p, _, _ = newTestMitmServer(t)
+				if err := p.SetMitmRules(&MitmRules{Tunnel: []string{"127.0.0.1"}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			conn := dialProxy(t, p)
+			if _, err := io.WriteString(conn, connectRequest(closedAddr(t))); err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "connect error during dial") {
+				t.Fatalf("got %v %q", res.Status, body)
+			}
+		})
+	}
+}
+
+func TestMitmRequestToClosedPort(t *testing.T) {
+	p, ca, _ := newTestMitmServer(t)
+	ctxs := make(chan *ProxyCtx, 1)
+	p.Hook = func(ctx *ProxyCtx) { ctxs <- ctx }
+
+	res, body := mitmGet(t, p, ca, closedAddr(t))
+	if res.StatusCode != http.StatusBadGateway || !strings.Contains(body, "connect error during dial") {
+		t.Fatalf("got %v %q", res.Status, body)
+	}
+	if ctx := <-ctxs; ctx.Error == nil || ctx.Error.Kind != ERRCONNECT || ctx.Response.StatusCode != http.StatusBadGateway {
+		t.Fatalf("recorded the error %v, status %v", ctx.Error, ctx.Response.StatusCode)
+	}
+}
+
+func TestPlainRequestToClosedPort(t *testing.T) {
+	p := NewProxyServer(nil)
+	ctxs := make(chan *ProxyCtx, 1)
+	p.Hook = func(ctx *ProxyCtx) { ctxs <- ctx }
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	res, err := client.Get("http://" + closedAddr(t) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %v", res.Status)
+	}
+	if ctx := <-ctxs; ctx.Error == nil || ctx.Error.Kind != ERRCONNECT || ctx.Error.Phase != PHASEDIAL {
+		t.Fatalf("recorded the error %v", ctx.Error)
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// flightCall is an in-flight or finished leaf certificate generation
+type flightCall struct {
+	wg      sync.WaitGroup
+	keypair *tls.Certificate
+	err     error
+}
+
+// flightGroup makes sure only one leaf certificate is generated per host
+// at a time, concurrent callers for the same host wait for the result
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// Do runs fn once for the host, and returns whether the result was shared
+func (g *flightGroup) Do(host string, fn func() (*tls.Certificate, error)) (*tls.Certificate, error, bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[host]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.keypair, c.err, true
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[host] = c
+	g.mu.Unlock()
+
+	// the waiters are released and the call forgotten even if fn panics,
+	// the panic goes on up the stack of this caller
+	returned := false
+	defer func() {
+		if !returned {
+			c.keypair, c.err = nil, fmt.Errorf("the issuance for %v panicked", host)
+		}
+		g.mu.Lock()
+		delete(g.calls, host)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.keypair, c.err = fn()
+	returned = true
+
+	return c.keypair, c.err, false
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupSharesOneCall(t *testing.T) {
+	g := newFlightGroup()
+	keypair := &tls.Certificate{}
+	release := make(chan struct{})
+	var calls, shared, entered int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			atomic.AddInt32(&entered, 1)
+			got, err, isShared := g.Do("example.test", func() (*tls.Certificate, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return keypair, nil
+			})
+			if err != nil || got != keypair {
+				t.Errorf("got %v, %v", got, err)
+			}
+			if isShared {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	// let the callers pile up on the first call
+	for atomic.LoadInt32(&entered) < 8 || atomic.LoadInt32(&calls) < 1 {
+		runtime.Gosched()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("fn ran %v times, want 1", calls)
+	}
+	if calls+shared != 8 {
+		t.Errorf("%v callers shared the result, want 7", shared)
+	}
+}
+
+func TestFlightGroupForgetsFinishedCalls(t *testing.T) {
+	g := newFlightGroup()
+	fail := errors.New("boom")
+	if _, err, _ := g.Do("example.test", func() (*tls.Certificate, error) { return nil, fail }); err != fail {
+		t.Fatalf("err = %v, want %v", err, fail)
+	}
+	keypair := &tls.Certificate{}
+	got, err, shared := g.Do("example.test", func() (*tls.Certificate, error) { return keypair, nil })
+	if err != nil || got != keypair || shared {
+		t.Fatalf("a finished call was reused: %v, %v, %v", got, err, shared)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := newFlightGroup()
+	entered, release := make(chan struct{}), make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		g.Do("example.test", func() (*tls.Certificate, error) {
+			close(entered)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-entered
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err, _ := g.Do("example.test", func() (*tls.Certificate, error) {
+			t.Error("the waiter ran its own call")
+			return nil, nil
+		})
+		waited <- err
+	}()
+	// let the waiter join the call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if r := <-panicked; r != "boom" {
+		t.Fatalf("recovered %v, want the panic of fn", r)
+	}
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Error("the waiter of a panicked call got no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiter of a panicked call is still blocked")
+	}
+	keypair := &tls.Certificate{}
+	got, err, shared := g.Do("example.test", func() (*tls.Certificate, error) { return keypair, nil })
+	if err != nil || got != keypair || shared {
+		t.Fatalf("the panicked call was reused: %v, %v, %v", got, err, shared)
+	}
+}
+
+func TestGetKeyPairCountsOneMissPerIssuance(t *testing.T) {
+	p, _, cache := newTestMitmServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.getKeyPair(newProxyConn("").newRequest(), "example.test"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// the lookups started after the issuance are hits
+	before := cache.Stats()
+	if before.Misses != 1 {
+		t.Errorf("misses = %v after one issuance, want 1", before.Misses)
+	}
+
+	if _, err := p.getKeyPair(newProxyConn("").newRequest(), "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Hits != before.Hits+1 {
+		t.Errorf("stats = %+v after a cached lookup, want one more hit than %+v", stats, before)
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"xiaolongbaoproxy/pkg/key"
+	"xiaolongbaoproxy/pkg/keycache"
+)
+
+// newTestCA generates a throwaway CA, nothing is written to disk
+func newTestCA(t *testing.T) (*key.Certificate, *key.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xiaolongbao test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := key.ParseCertificate(pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_CERTIFICATE, Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := key.ParsePK(pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_PRIVATE_KEY, Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pk
+}
+
+// newTestMitmServer is a mitm proxy with an in-memory CA and cache
+func newTestMitmServer(t *testing.T, opts ...Option) (*ProxyServer, *key.Certificate, *keycache.MemCertCache) {
+	t.Helper()
+	cert, pk := newTestCA(t)
+	cache := keycache.NewMemCertCache(cert)
+	p, err := New(append([]Option{WithCA(cert, pk), WithCertCache(cache)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, cert, cache
+}
+
+// writeTestCA writes the PEM encoded CA into dir and returns the paths
+func writeTestCA(t *testing.T, dir string, certPem, pkPem []byte) (string, string) {
+	t.Helper()
+	certpath, pkpath := filepath.Join(dir, "root.crt"), filepath.Join(dir, "root.key")
+	if err := ioutil.WriteFile(certpath, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pkpath, pkPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certpath, pkpath
+}
+
+func newTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newFileCAMitmServer is like newTestMitmServer but the CA is read from
+// files, for the tests reloading it
+func newFileCAMitmServer(t *testing.T) (*ProxyServer, *key.Certificate) {
+	t.Helper()
+	cert, pk := newTestCA(t)
+	certpath, pkpath := writeTestCA(t, newTempDir(t), cert.PEMEncoded(), pk.PEMEncoded())
+	p, err := New(WithCAFiles(certpath, pkpath), WithCertCacheStore(keycache.MEMSCHEME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, cert
+}
+
+// mapDialer sends the connections to the addresses of the upstreams started
+// by the test, the other addresses are dialed as is
+type mapDialer map[string]string
+
+func (d mapDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if to, ok := d[addr]; ok {
+		addr = to
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
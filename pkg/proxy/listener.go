@@ -1,13 +1,13 @@
 package proxy
 
 import (
-	"crypto/tls"
 	"io"
 	"net"
 )
 
+// HttpsListener hands a single connection to an http server
 type HttpsListener struct {
-	conn *tls.Conn
+	conn net.Conn
 }
 
 func (l *HttpsListener) Accept() (net.Conn, error) {
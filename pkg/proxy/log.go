@@ -0,0 +1,27 @@
+package proxy
+
+import "go.uber.org/zap"
+
+// the names of the loggers, the level of each can be set on its own
+const (
+	LOGGERPROXY = "proxy"
+	LOGGERTLS   = "tls"
+)
+
+// baseLogger is the logger given to New, or the global one
+func (p *ProxyServer) baseLogger() *zap.SugaredLogger {
+	if p.log != nil {
+		return p.log
+	}
+	return zap.S()
+}
+
+// logger logs the requests and the tunnels
+func (p *ProxyServer) logger() *zap.SugaredLogger {
+	return p.baseLogger().Named(LOGGERPROXY)
+}
+
+// tlsLogger logs the certificates and the handshakes of both legs
+func (p *ProxyServer) tlsLogger() *zap.SugaredLogger {
+	return p.baseLogger().Named(LOGGERTLS)
+}
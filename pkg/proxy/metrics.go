@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// METRICSNAMESPACE prefixes the names of the metrics
+const METRICSNAMESPACE = "xiaolongbao"
+
+// metrics are the prometheus collectors of a proxy server, each server has
+// its own registry
+type metrics struct {
+	registry          *prometheus.Registry
+	requests          *prometheus.CounterVec
+	errors            *prometheus.CounterVec
+	bytes             *prometheus.CounterVec
+	requestDuration   prometheus.Histogram
+	upstreamLatency   prometheus.Histogram
+	activeTunnels     prometheus.Gauge
+	handshakeFailures prometheus.Counter
+	leafGeneration    prometheus.Histogram
+}
+
+func newMetrics(p *ProxyServer) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "requests_total",
+			Help:      "Requests by method, status code and host, a tunnel counts as a CONNECT.",
+		}, []string{"method", "status", "host"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "request_errors_total",
+			Help:      "Failed requests by kind and phase.",
+		}, []string{"kind", "phase"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "bytes_total",
+			Help:      "Bytes on the upstream connections, in is from the upstream, out is to the upstream.",
+		}, []string{"direction"}),
+		requestDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "request_duration_seconds",
+			Help:      "Time from the request received to the response completed.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		upstreamLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "upstream_latency_seconds",
+			Help:      "Time from the request sent upstream to the first response byte.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		activeTunnels: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "active_tunnels",
+			Help:      "CONNECT tunnels currently open.",
+		}),
+		handshakeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "mitm_handshake_failures_total",
+			Help:      "Failed tls handshakes with the clients of intercepted tunnels.",
+		}),
+		leafGeneration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: METRICSNAMESPACE,
+			Name:      "leaf_generation_seconds",
+			Help:      "Time to issue a leaf certificate, key generation included.",
+			Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests, m.errors, m.bytes, m.requestDuration, m.upstreamLatency,
+		m.activeTunnels, m.handshakeFailures, m.leafGeneration,
+	)
+
+	// the cert cache counters are read at scrape time
+	if p.certCache != nil {
+		m.registry.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: METRICSNAMESPACE,
+				Name:      "cert_cache_hits_total",
+				Help:      "Leaf certificates served from the cache, in memory or from its store.",
+			}, func() float64 { return float64(p.certCache.Stats().Hits) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: METRICSNAMESPACE,
+				Name:      "cert_cache_misses_total",
+				Help:      "Leaf certificates not found in the cache, nor in its store.",
+			}, func() float64 { return float64(p.certCache.Stats().Misses) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: METRICSNAMESPACE,
+				Name:      "cert_cache_size",
+				Help:      "Leaf certificates in the memory tier of the cache.",
+			}, func() float64 { return float64(p.certCache.Stats().Size) }),
+		)
+	}
+	return m
+}
+
+// observe records a request reported to the hook
+func (m *metrics) observe(ctx *ProxyCtx) {
+	host := ctx.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	m.requests.WithLabelValues(ctx.Request.Method, strconv.Itoa(ctx.Response.StatusCode), host).Inc()
+	if ctx.Error != nil {
+		m.errors.WithLabelValues(string(ctx.Error.Kind), ctx.Error.Phase).Inc()
+	}
+	m.bytes.WithLabelValues("out").Add(float64(ctx.Request.Bytes.Wire))
+	m.bytes.WithLabelValues("in").Add(float64(ctx.Response.Bytes.Wire))
+	if d := ctx.Timing.Total(); d > 0 {
+		m.requestDuration.Observe(d.Seconds())
+	}
+	if d := ctx.Timing.Wait(); d > 0 {
+		m.upstreamLatency.Observe(d.Seconds())
+	}
+}
+
+func (m *metrics) observeLeafGeneration(d time.Duration) {
+	m.leafGeneration.Observe(d.Seconds())
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
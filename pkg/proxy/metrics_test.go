@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"xiaolongbaoproxy/pkg/keycache"
+)
+
+// scrapeMetrics returns the /metrics page of the admin API of p
+func scrapeMetrics(t *testing.T, p *ProxyServer) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestRequestMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+	p := NewProxyServer(nil)
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	res, err := client.Get(upstream.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	// the hook, and the metrics, run after the response is sent
+	deadline := time.Now().Add(5 * time.Second)
+	want := `xiaolongbao_requests_total{host="127.0.0.1",method="GET",status="200"} 1`
+	page := scrapeMetrics(t, p)
+	for !strings.Contains(page, want+"\n") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		page = scrapeMetrics(t, p)
+	}
+	for _, series := range []string{
+		want,
+		"xiaolongbao_request_duration_seconds_count 1",
+		"xiaolongbao_upstream_latency_seconds_count 1",
+		"xiaolongbao_active_tunnels 0",
+	} {
+		if !strings.Contains(page, series+"\n") {
+			t.Errorf("no %q in the metrics", series)
+		}
+	}
+	for _, name := range []string{`xiaolongbao_bytes_total{direction="in"} 0`, `xiaolongbao_bytes_total{direction="out"} 0`} {
+		if strings.Contains(page, name+"\n") {
+			t.Errorf("%q, the upstream bytes are not counted", name)
+		}
+	}
+	if strings.Contains(page, "cert_cache") {
+		t.Error("cert cache metrics for a proxy without cache")
+	}
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	p, _, _ := newTestMitmServer(t)
+	conn := dialProxy(t, p)
+	fmt.Fprint(conn, connectRequest("127.0.0.1:443"))
+	readConnectResponse(t, bufio.NewReader(conn))
+	if page := scrapeMetrics(t, p); !strings.Contains(page, "xiaolongbao_active_tunnels 1\n") {
+		t.Error("the open tunnel is not counted")
+	}
+
+	// not a client hello, the handshake fails
+	fmt.Fprint(conn, "\x16\x03\x01\x00\x01\x00")
+	conn.Close()
+	// the CONNECT is counted once the tunnel is done
+	want := `xiaolongbao_requests_total{host="127.0.0.1",method="CONNECT",status="200"} 1`
+	deadline := time.Now().Add(5 * time.Second)
+	page := scrapeMetrics(t, p)
+	for !strings.Contains(page, want+"\n") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		page = scrapeMetrics(t, p)
+	}
+	for _, series := range []string{
+		"xiaolongbao_active_tunnels 0",
+		"xiaolongbao_mitm_handshake_failures_total 1",
+		want,
+	} {
+		if !strings.Contains(page, series+"\n") {
+			t.Errorf("no %q in the metrics", series)
+		}
+	}
+}
+
+func TestCertCacheMetrics(t *testing.T) {
+	p, _, _ := newTestMitmServer(t)
+	for i := 0; i < 2; i++ {
+		if _, err := p.getKeyPair(NewProxyCtx(), "example.test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page := scrapeMetrics(t, p)
+	for _, series := range []string{
+		"xiaolongbao_cert_cache_hits_total 1",
+		"xiaolongbao_cert_cache_misses_total 1",
+		"xiaolongbao_cert_cache_size 1",
+		"xiaolongbao_leaf_generation_seconds_count 1",
+	} {
+		if !strings.Contains(page, series+"\n") {
+			t.Errorf("no %q in the metrics", series)
+		}
+	}
+}
+
+func TestCertCacheMetricsFromConfig(t *testing.T) {
+	cert, pk := newTestCA(t)
+	c := DefaultConfig()
+	c.CA.Cert, c.CA.Key = writeTestCA(t, newTempDir(t), cert.PEMEncoded(), pk.PEMEncoded())
+	c.Cache.Store = keycache.MEMSCHEME
+
+	p, err := NewProxyServerFromConfig(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if page := scrapeMetrics(t, p); !strings.Contains(page, "xiaolongbao_cert_cache_misses_total 0\n") {
+		t.Error("no cert cache metrics for a proxy created from a config")
+	}
+}
+
+func TestNoCertCacheMetricsForBasic(t *testing.T) {
+	p, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if page := scrapeMetrics(t, p); strings.Contains(page, "cert_cache") {
+		t.Error("cert cache metrics for a proxy without cache")
+	}
+}
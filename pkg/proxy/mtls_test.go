@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xiaolongbaoproxy/pkg/key"
+)
+
+// writeTestLeaf issues a leaf for cn and writes it as cert and key files
+func writeTestLeaf(t *testing.T, cacert *key.Certificate, cakey *key.PrivateKey, cn string) (string, string) {
+	t.Helper()
+	cert, pk, err := key.CertificateForKey(cn, cakey, cacert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := newTempDir(t)
+	certpath, pkpath := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	if err := ioutil.WriteFile(certpath, cert.PEMEncoded(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pkpath, pk.PEMEncoded(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certpath, pkpath
+}
+
+func TestUpstreamClientCertPerHost(t *testing.T) {
+	cacert, cakey := newTestCA(t)
+	var certs []ClientCert
+	for pattern, cn := range map[string]string{"*.a.test": "wildcard", "b.test": "exact"} {
+		certpath, pkpath := writeTestLeaf(t, cacert, cakey, cn)
+		certs = append(certs, ClientCert{Host: pattern, Cert: certpath, Key: pkpath})
+	}
+	ut, err := (&UpstreamTls{ClientCerts: certs}).build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		cn   string
+	}{
+		{"www.a.test", "wildcard"},
+		{"b.test", "exact"},
+		{"a.test", ""},
+		{"c.test", ""},
+	}
+	for _, tt := range tests {
+		config := ut.configFor(tt.host)
+		cn := ""
+		if len(config.Certificates) == 1 {
+			leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			cn = leaf.Subject.CommonName
+		} else if len(config.Certificates) > 1 {
+			t.Fatalf("%v got %v certificates", tt.host, len(config.Certificates))
+		}
+		if cn != tt.cn {
+			t.Errorf("%v got the certificate %q, want %q", tt.host, cn, tt.cn)
+		}
+	}
+}
+
+func TestUpstreamClientCertMissingFile(t *testing.T) {
+	dir := newTempDir(t)
+	u := &UpstreamTls{ClientCerts: []ClientCert{{Host: "a.test", Cert: filepath.Join(dir, "a.crt"), Key: filepath.Join(dir, "a.key")}}}
+	if _, err := u.build(); err == nil {
+		t.Fatal("a missing client certificate was accepted")
+	}
+}
+
+func TestUpstreamMutualTls(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "https://")
+
+	p, ca, _ := newTestMitmServer(t)
+	_, cakey := p.CA()
+	certpath, pkpath := writeTestLeaf(t, ca, cakey, "proxy client")
+	err := p.SetUpstreamTls(&UpstreamTls{
+		InsecureHosts: []string{"127.0.0.1"},
+		ClientCerts:   []ClientCert{{Host: "127.0.0.1", Cert: certpath, Key: pkpath}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body := mitmGet(t, p, ca, target)
+	if res.StatusCode != http.StatusOK || body != "proxy client" {
+		t.Fatalf("got %v %q", res.StatusCode, body)
+	}
+
+	// without a certificate the upstream rejects the handshake, with tls 1.3
+	// only once the proxy reads the response
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := mitmGet(t, p, ca, target); res.StatusCode == http.StatusOK {
+		t.Fatalf("got %v without a client certificate", res.StatusCode)
+	}
+}
+
+func TestClientCertificatesInCtx(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	p, ca, _ := newTestMitmServer(t)
+	_, cakey := p.CA()
+	tp := DefaultTlsPolicy()
+	tp.ClientAuth = "request"
+	if err := p.SetTlsPolicy(tp); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctxs := make(chan *ProxyCtx, 1)
+	p.Hook = func(ctx *ProxyCtx) { ctxs <- ctx }
+
+	certpath, pkpath := writeTestLeaf(t, ca, cakey, "browser")
+	clientCert, err := tls.LoadX509KeyPair(certpath, pkpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+	}}
+	res, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	ctx := <-ctxs
+	if len(ctx.Request.ClientCertificates) != 1 || ctx.Request.ClientCertificates[0].Subject.CommonName != "browser" {
+		t.Fatalf("client certificates = %v", ctx.Request.ClientCertificates)
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"xiaolongbaoproxy/pkg/key"
+	"xiaolongbaoproxy/pkg/keycache"
+
+	"go.uber.org/zap"
+)
+
+// options are collected by the Option of New before the server is built
+type options struct {
+	cert       *key.Certificate
+	pk         *key.PrivateKey
+	certPath   string
+	keyPath    string
+	cache      keycache.CertCache
+	cacheStore string
+	keyPool    int
+	tr         *http.Transport
+	dialer     Dialer
+	log        *zap.SugaredLogger
+	hooks      []func(*ProxyCtx)
+	connHooks  []func(*ProxyConn)
+}
+
+// Option configures the server created by New
+type Option func(*options) error
+
+// WithCA intercepts the tunnels with leaves issued by an in-memory CA
+func WithCA(cert *key.Certificate, pk *key.PrivateKey) Option {
+	return func(o *options) error {
+		if err := key.ValidateCA(cert, pk); err != nil {
+			return fmt.Errorf("invalid CA: %v", err)
+		}
+		o.cert, o.pk = cert, pk
+		o.certPath, o.keyPath = "", ""
+		return nil
+	}
+}
+
+// WithCAFiles reads the CA from PEM files, ReloadCA reads them again
+func WithCAFiles(certpath, pkpath string) Option {
+	return func(o *options) error {
+		cert, pk, err := loadCA(certpath, pkpath)
+		if err != nil {
+			return fmt.Errorf("load CA failed: %v", err)
+		}
+		o.cert, o.pk = cert, pk
+		o.certPath, o.keyPath = certpath, pkpath
+		return nil
+	}
+}
+
+// WithCertCache keeps the leaves in c, which the server closes on Close.
+// The default is an in-memory cache.
+func WithCertCache(c keycache.CertCache) Option {
+	return func(o *options) error {
+		o.cache, o.cacheStore = c, ""
+		return nil
+	}
+}
+
+// WithCertCacheStore opens the cache described by uri, see
+// keycache.NewCertCache
+func WithCertCacheStore(uri string) Option {
+	return func(o *options) error {
+		o.cacheStore, o.cache = uri, nil
+		return nil
+	}
+}
+
+// WithKeyPool pre-generates n leaf keys
+func WithKeyPool(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("invalid key pool size: %v", n)
+		}
+		o.keyPool = n
+		return nil
+	}
+}
+
+// WithTransport sends the plain http requests through tr, it is used as
+// is, so its bytes are not counted in ProxyBytes
+func WithTransport(tr *http.Transport) Option {
+	return func(o *options) error {
+		o.tr = tr
+		return nil
+	}
+}
+
+// WithDialer connects the tunnels, the intercepted ones included, and the
+// default transport to the upstreams through d
+func WithDialer(d Dialer) Option {
+	return func(o *options) error {
+		o.dialer = d
+		return nil
+	}
+}
+
+// WithLogger logs to l instead of the global logger, the proxy and tls
+// loggers are named after it
+func WithLogger(l *zap.SugaredLogger) Option {
+	return func(o *options) error {
+		o.log = l
+		return nil
+	}
+}
+
+// WithHook adds a hook run after each request, the hooks run in the order
+// they are given
+func WithHook(hook func(*ProxyCtx)) Option {
+	return func(o *options) error {
+		if hook != nil {
+			o.hooks = append(o.hooks, hook)
+		}
+		return nil
+	}
+}
+
+// WithConnHook adds a hook run when a client connection is closed, the
+// hooks run in the order they are given
+func WithConnHook(hook func(*ProxyConn)) Option {
+	return func(o *options) error {
+		if hook != nil {
+			o.connHooks = append(o.connHooks, hook)
+		}
+		return nil
+	}
+}
+
+// New creates a proxy server without reading any file unless asked to, nor
+// exiting on error. It intercepts the tunnels if a CA is given, and only
+// forwards them otherwise.
+func New(opts ...Option) (*ProxyServer, error) {
+	o := &options{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.cert == nil && (o.cache != nil || o.cacheStore != "" || o.keyPool > 0) {
+		return nil, fmt.Errorf("a cert cache or a key pool needs a CA")
+	}
+
+	p := &ProxyServer{
+		Mitm:     o.cert != nil,
+		Tr:       o.tr,
+		Hook:     chainHooks(o.hooks),
+		ConnHook: chainConnHooks(o.connHooks),
+		dialer:   o.dialer,
+		log:      o.log,
+		tunnels:  newTunnelTracker(),
+	}
+	if p.dialer == nil {
+		p.dialer = &net.Dialer{}
+	}
+	if p.Tr == nil {
+		p.Tr = newTransport(p.dialer)
+	}
+	if p.Mitm {
+		if err := p.initMitm(o); err != nil {
+			return nil, err
+		}
+	}
+	// after the cache, its counters are registered only if there is one
+	p.metrics = newMetrics(p)
+	p.SetTracerProvider(nil)
+	return p, nil
+}
+
+// initMitm sets up the CA, the cert cache and the default settings
+func (p *ProxyServer) initMitm(o *options) error {
+	cache := o.cache
+	if cache == nil {
+		if o.cacheStore == "" {
+			o.cacheStore = keycache.MEMSCHEME
+		}
+		var err error
+		if cache, err = keycache.NewCertCache(o.cacheStore, o.cert); err != nil {
+			return fmt.Errorf("initalize cert cache failed: %v", err)
+		}
+	} else {
+		cache.SetCA(o.cert)
+	}
+	p.caCertPath, p.caKeyPath = o.certPath, o.keyPath
+	p.certCache = cache
+	p.certFlight = newFlightGroup()
+	p.fakeServerPool = &sync.Pool{
+		New: func() interface{} {
+			return new(http.Server)
+		},
+	}
+	p.ca.Store(&caPair{cert: o.cert, pk: o.pk})
+	if err := p.SetTlsPolicy(DefaultTlsPolicy()); err != nil {
+		cache.Close()
+		return fmt.Errorf("invalid default tls policy: %v", err)
+	}
+	if err := p.SetUpstreamTls(&UpstreamTls{}); err != nil {
+		cache.Close()
+		return fmt.Errorf("invalid default upstream tls: %v", err)
+	}
+	p.SetAutoPassthrough(PASSTHROUGHTHRESHOLD, PASSTHROUGHTTL)
+	if o.keyPool > 0 {
+		p.KeyPool = key.NewKeyPool(o.keyPool)
+	}
+	p.sweeper = keycache.StartSweeper(cache, keycache.SWEEPINTERVAL)
+	return nil
+}
+
+func chainHooks(hooks []func(*ProxyCtx)) func(*ProxyCtx) {
+	switch len(hooks) {
+	case 0:
+		return nil
+	case 1:
+		return hooks[0]
+	}
+	return func(ctx *ProxyCtx) {
+		for _, hook := range hooks {
+			hook(ctx)
+		}
+	}
+}
+
+func chainConnHooks(hooks []func(*ProxyConn)) func(*ProxyConn) {
+	switch len(hooks) {
+	case 0:
+		return nil
+	case 1:
+		return hooks[0]
+	}
+	return func(conn *ProxyConn) {
+		for _, hook := range hooks {
+			hook(conn)
+		}
+	}
+}
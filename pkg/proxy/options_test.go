@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"xiaolongbaoproxy/pkg/keycache"
+)
+
+func TestNewErrors(t *testing.T) {
+	cert, pk := newTestCA(t)
+	_, otherPk := newTestCA(t)
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"cache without a CA", []Option{WithCertCacheStore(keycache.MEMSCHEME)}},
+		{"key pool without a CA", []Option{WithKeyPool(4)}},
+		{"negative key pool", []Option{WithCA(cert, pk), WithKeyPool(-1)}},
+		{"mismatched CA", []Option{WithCA(cert, otherPk)}},
+		{"missing CA files", []Option{WithCAFiles(filepath.Join(newTempDir(t), "root.crt"), filepath.Join(newTempDir(t), "root.key"))}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if p, err := New(test.opts...); err == nil {
+				p.Close()
+				t.Fatal("New succeeded")
+			}
+		})
+	}
+}
+
+func TestNewWithoutCATunnels(t *testing.T) {
+	echo := startEchoServer(t)
+	p, err := New(WithDialer(mapDialer{"example.test:443": echo}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Mitm {
+		t.Fatal("a server without a CA intercepts")
+	}
+
+	conn := dialProxy(t, p)
+	if _, err := io.WriteString(conn, connectRequest("example.test:443")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	readConnectResponse(t, r)
+	greeting := "SSH-2.0-test\r\n"
+	if _, err := io.WriteString(conn, greeting); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(greeting))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != greeting {
+		t.Fatalf("the echo server answered %q", got)
+	}
+}
+
+func TestWithHooksRunInOrder(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+	ran := make(chan string, 3)
+	p, err := New(
+		WithDialer(mapDialer{"example.test:80": upstream.Listener.Addr().String()}),
+		WithHook(func(*ProxyCtx) { ran <- "first" }),
+		WithHook(nil),
+		WithHook(func(*ProxyCtx) { ran <- "second" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	// example.test only resolves through the dialer
+	res, err := client.Get("http://example.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello" {
+		t.Fatalf("got %q", body)
+	}
+
+	var order []string
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-ran:
+			order = append(order, name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the hooks did not run")
+		}
+	}
+	if got := strings.Join(order, ","); got != "first,second" {
+		t.Errorf("the hooks ran as %v", got)
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// PASSTHROUGHTHRESHOLD is how many rejected handshakes switch a host to tunnelling
+	PASSTHROUGHTHRESHOLD = 2
+	// PASSTHROUGHTTL is how long a host stays tunnelled after it was switched
+	PASSTHROUGHTTL = time.Hour
+	// PASSTHROUGHFAILUREWINDOW is how long a rejected handshake is counted,
+	// the failures of a host are forgotten once it had none for this long
+	PASSTHROUGHFAILUREWINDOW = 10 * time.Minute
+)
+
+type passthroughEntry struct {
+	failures    int
+	lastFailure time.Time
+	until       time.Time
+}
+
+// stale tells whether the entry neither tunnels its host nor counts recent
+// failures any more
+func (e *passthroughEntry) stale(now time.Time) bool {
+	if e.until.IsZero() {
+		return now.Sub(e.lastFailure) > PASSTHROUGHFAILUREWINDOW
+	}
+	return now.After(e.until)
+}
+
+// passthroughTracker remembers the hosts whose clients reject our forged
+// certificate (e.g. pinned apps), and tunnels them for a while
+type passthroughTracker struct {
+	mu        sync.Mutex
+	threshold int
+	ttl       time.Duration
+	hosts     map[string]*passthroughEntry
+	lastSweep time.Time
+	logger    func() *zap.SugaredLogger
+	now       func() time.Time
+}
+
+func newPassthroughTracker(threshold int, ttl time.Duration, logger func() *zap.SugaredLogger) *passthroughTracker {
+	return &passthroughTracker{
+		threshold: threshold,
+		ttl:       ttl,
+		hosts:     make(map[string]*passthroughEntry),
+		logger:    logger,
+		now:       time.Now,
+	}
+}
+
+// Active tells whether host is currently tunnelled
+func (t *passthroughTracker) Active(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.hosts[host]
+	if !ok || e.until.IsZero() {
+		return false
+	}
+	if t.now().After(e.until) {
+		delete(t.hosts, host)
+		t.logger().Infof("[tls] passthrough for %v expired, intercept it again", host)
+		return false
+	}
+	return true
+}
+
+// Failed records a rejected handshake for host
+func (t *passthroughTracker) Failed(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+	e, ok := t.hosts[host]
+	if !ok || e.stale(now) {
+		e = &passthroughEntry{}
+		t.hosts[host] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures >= t.threshold && e.until.IsZero() {
+		e.until = now.Add(t.ttl)
+		t.logger().Warnf("[tls] clients rejected the certificate of %v %v times, tunnel it until %v",
+			host, e.failures, e.until.Format(time.RFC3339))
+	}
+}
+
+// Succeeded forgets the failures of host
+func (t *passthroughTracker) Succeeded(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.hosts[host]; ok && e.until.IsZero() {
+		delete(t.hosts, host)
+	}
+}
+
+// sweep evicts the stale entries, at most once per failure window
+func (t *passthroughTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < PASSTHROUGHFAILUREWINDOW {
+		return
+	}
+	t.lastSweep = now
+	for host, e := range t.hosts {
+		if e.stale(now) {
+			delete(t.hosts, host)
+		}
+	}
+}
+
+// the alerts a client sends when it refuses the certificate, as reported by
+// crypto/tls
+var certRejectionAlerts = map[string]bool{
+	"tls: bad certificate":               true,
+	"tls: unknown certificate authority": true,
+	"tls: unknown certificate":           true,
+}
+
+// isCertRejection tells whether a server side handshake error is an alert
+// of the client refusing our certificate. A hang up, e.g. an abandoned or
+// speculative connection, does not count.
+func isCertRejection(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+	return certRejectionAlerts[opErr.Err.Error()]
+}
+
+// SetAutoPassthrough makes the proxy tunnel a host for ttl once its clients
+// rejected the forged certificate threshold times, a threshold of 0 disables it
+func (p *ProxyServer) SetAutoPassthrough(threshold int, ttl time.Duration) {
+	var t *passthroughTracker
+	if threshold > 0 {
+		t = newPassthroughTracker(threshold, ttl, p.tlsLogger)
+	}
+	p.updateSettings(func(s *proxySettings) {
+		s.passthrough = t
+	})
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// timeoutError is a net.Error of an idle client
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// serverHandshake returns the error of the proxy side of a handshake with a
+// client doing client(conn)
+func serverHandshake(t *testing.T, client func(conn net.Conn)) error {
+	t.Helper()
+	p, _, _ := newTestMitmServer(t)
+	keypair, err := p.getKeyPair(newProxyConn("").newRequest(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		defer clientConn.Close()
+		client(clientConn)
+	}()
+	server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{*keypair}})
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return server.Handshake()
+}
+
+func TestIsCertRejection(t *testing.T) {
+	tests := []struct {
+		name   string
+		client func(conn net.Conn)
+		want   bool
+	}{
+		{"unknown ca", func(conn net.Conn) {
+			tls.Client(conn, &tls.Config{ServerName: "example.test"}).Handshake()
+		}, true},
+		{"hang up", func(conn net.Conn) {}, false},
+		{"hang up after the client hello", func(conn net.Conn) {
+			conn.Write([]byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x00})
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := serverHandshake(t, tt.client)
+			if err == nil {
+				t.Fatal("the handshake succeeded")
+			}
+			if got := isCertRejection(err); got != tt.want {
+				t.Errorf("isCertRejection(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPassthroughTracker(t *testing.T) {
+	tracker := newPassthroughTracker(2, 50*time.Millisecond, zap.S)
+
+	tracker.Failed("a.test")
+	if tracker.Active("a.test") {
+		t.Fatal("one failure tunnels the host")
+	}
+	tracker.Succeeded("a.test")
+	tracker.Failed("a.test")
+	if tracker.Active("a.test") {
+		t.Fatal("a success did not reset the failures")
+	}
+	tracker.Failed("a.test")
+	if !tracker.Active("a.test") {
+		t.Fatal("the host is not tunnelled after the threshold")
+	}
+	tracker.Succeeded("a.test")
+	if !tracker.Active("a.test") {
+		t.Fatal("a success ended the passthrough early")
+	}
+	if tracker.Active("b.test") {
+		t.Fatal("another host is tunnelled")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if tracker.Active("a.test") {
+		t.Fatal("the host is still tunnelled after the ttl")
+	}
+}
+
+func TestAutoPassthrough(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	p, _, _ := newTestMitmServer(t)
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+
+	// a pinned client only trusts the upstream certificate
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyUrl),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		DisableKeepAlives: true,
+	}}
+	for i := 0; i < PASSTHROUGHTHRESHOLD; i++ {
+		if _, err := client.Get(upstream.URL); err == nil {
+			t.Fatal("the client accepted the forged certificate")
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.loadSettings().passthrough.Active("127.0.0.1") {
+		if time.Now().After(deadline) {
+			t.Fatal("the rejected host was not tunnelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v", res.Status)
+	}
+}
+
+func TestPassthroughTrackerExpiresFailures(t *testing.T) {
+	now := time.Now()
+	tracker := newPassthroughTracker(2, time.Hour, zap.S)
+	tracker.now = func() time.Time { return now }
+
+	tracker.Failed("a.test")
+	now = now.Add(PASSTHROUGHFAILUREWINDOW + time.Second)
+	tracker.Failed("a.test")
+	if tracker.Active("a.test") {
+		t.Fatal("failures apart by more than the window tunnel the host")
+	}
+	tracker.Failed("a.test")
+	if !tracker.Active("a.test") {
+		t.Fatal("failures within the window do not tunnel the host")
+	}
+
+	now = now.Add(time.Hour + time.Second)
+	if tracker.Active("a.test") {
+		t.Error("the host is still tunnelled after the ttl")
+	}
+}
+
+func TestPassthroughTrackerEvictsStaleHosts(t *testing.T) {
+	now := time.Now()
+	tracker := newPassthroughTracker(2, time.Hour, zap.S)
+	tracker.now = func() time.Time { return now }
+
+	tracker.Failed("a.test")
+	tracker.Failed("b.test")
+	tracker.Failed("b.test")
+	now = now.Add(time.Hour + PASSTHROUGHFAILUREWINDOW)
+	tracker.Failed("c.test")
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if len(tracker.hosts) != 1 || tracker.hosts["c.test"] == nil {
+		t.Errorf("hosts = %v, want only c.test", tracker.hosts)
+	}
+}
@@ -2,89 +2,170 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"xiaolongbaoproxy/pkg/key"
 	"xiaolongbaoproxy/pkg/keycache"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type ProxyServer struct {
-	Mitm           bool
-	Tr             *http.Transport
-	Hook           func(*ProxyCtx)
-	Cert           *key.Certificate
-	PrivateKey     *key.PrivateKey
-	TlsConfig      *tls.Config
-	certCache      *keycache.CertCache
+	Mitm bool
+	Tr   *http.Transport
+	Hook func(*ProxyCtx)
+	// ConnHook is called when a client connection is closed, the plain http
+	// ones only if the server is set up by ConfigureServer
+	ConnHook func(*ProxyConn)
+	KeyPool  *key.KeyPool
+	// settings holds the *proxySettings of the new tunnels
+	settings   atomic.Value
+	settingsMu sync.Mutex
+	ca         atomic.Value
+	// settingsMu serializes the reloads, caCertPath and caKeyPath are
+	// guarded by it
+	caCertPath     string
+	caKeyPath      string
+	certCache      keycache.CertCache
+	certFlight     *flightGroup
+	sweeper        *keycache.Sweeper
+	metrics        *metrics
+	tracer         trace.Tracer
+	accessLog      *AccessLog
+	tunnels        *tunnelTracker
+	clientConns    sync.Map
+	dialer         Dialer
+	log            *zap.SugaredLogger
 	fakeServerPool *sync.Pool
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
 
+// splitHostname strips the port of host:port, and the brackets of an ipv6
+func splitHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return strings.Trim(host, "[]")
+}
+
+const (
+	// HANDSHAKETIMEOUT bounds the tls handshake with the client of a mitm tunnel
+	HANDSHAKETIMEOUT = 10 * time.Second
+	// DIALTIMEOUT bounds the connection to the upstream, tls handshake included
+	DIALTIMEOUT = 5 * time.Second
+)
+
 func NewProxyServer(hook func(*ProxyCtx)) *ProxyServer {
-	return &ProxyServer{
-		Mitm: false,
-		Tr:   &http.Transport{},
-		Hook: hook,
+	p, _ := New(WithHook(hook))
+	return p
+}
+
+// Dialer connects to the upstreams, a *net.Dialer or e.g. an in-memory
+// network in tests
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newTransport counts the bytes on the upstream connections, see ProxyBytes
+func newTransport(dialer Dialer) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, DIALTIMEOUT)
+			defer cancel()
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn}, nil
+		},
+		// a custom dialer disables http2 unless forced
+		ForceAttemptHTTP2: true,
 	}
 }
 
+// NewMitmProxyServer exits if the CA or the cache can not be read, New
+// returns the error instead
 func NewMitmProxyServer(certpath, pkpath string, cachepath string, hook func(*ProxyCtx)) *ProxyServer {
-	cert, err := key.LoadCertificateFromFile(certpath)
+	p, err := New(WithCAFiles(certpath, pkpath), WithCertCacheStore(cachepath), WithHook(hook))
 	if err != nil {
-		zap.S().Fatalf("read cert failed: %v", err)
+		zap.S().Named(LOGGERPROXY).Fatalf("%v", err)
 	}
-	pk, err := key.LoadPKFromFile(pkpath)
+	return p
+}
+
+// SetTlsPolicy validates the policy and applies it to the new client connections
+func (p *ProxyServer) SetTlsPolicy(tp *TlsPolicy) error {
+	config, err := tp.Config()
 	if err != nil {
-		zap.S().Fatalf("read key failed: %v", err)
+		return err
 	}
-	cache, err := keycache.NewCertCache(cachepath, cert, pk)
-	if err != nil {
-		zap.S().Fatalf("initalize cert cache failed: %v", err)
-	}
-
-	return &ProxyServer{
-		Mitm:       true,
-		Tr:         &http.Transport{},
-		Hook:       hook,
-		Cert:       cert,
-		PrivateKey: pk,
-		TlsConfig: &tls.Config{
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
-				tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-				tls.TLS_RSA_WITH_RC4_128_SHA,
-				tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			},
-			PreferServerCipherSuites: true,
-			InsecureSkipVerify:       false},
-		certCache: cache,
-		fakeServerPool: &sync.Pool{
-			New: func() interface{} {
-				return new(http.Server)
-			},
-		},
+	p.updateSettings(func(s *proxySettings) {
+		s.clientTlsConfig = config
+	})
+	return nil
+}
+
+// proxyConnKey is the context key of the ProxyConn of a client connection
+type proxyConnKey struct{}
+
+// ConfigureServer makes srv share one ProxyConn between the requests of a
+// client connection, and call the ConnHook when it is closed. The
+// ConnContext and ConnState already set on srv are still called.
+func (p *ProxyServer) ConfigureServer(srv *http.Server) {
+	connContext, connState := srv.ConnContext, srv.ConnState
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		conn := newProxyConn(c.RemoteAddr().String())
+		p.clientConns.Store(c, conn)
+		return context.WithValue(ctx, proxyConnKey{}, conn)
+	}
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateHijacked:
+			// the tunnel ends the connection itself
+			p.clientConns.Delete(c)
+		case http.StateClosed:
+			if v, ok := p.clientConns.Load(c); ok {
+				p.clientConns.Delete(c)
+				conn := v.(*ProxyConn)
+				conn.End = time.Now()
+				if p.ConnHook != nil {
+					p.ConnHook(conn)
+				}
+			}
+		}
+		if connState != nil {
+			connState(c, state)
+		}
 	}
 }
 
 func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := NewProxyCtx()
-	zap.S().Infof("[%v] got request: %v, %v, from %v", ctx.Session, r.Method, r.URL, r.RemoteAddr)
+	conn, ok := r.Context().Value(proxyConnKey{}).(*ProxyConn)
+	if !ok {
+		// the server is not set up by ConfigureServer
+		conn = newProxyConn(r.RemoteAddr)
+	}
+	ctx := conn.newRequest()
+	if user := proxyUser(r); user != "" {
+		ctx.Conn.ProxyUser = user
+	}
+	p.logger().Infof("[%v] got request: %v, %v, from %v", ctx.Session, r.Method, r.URL, r.RemoteAddr)
 	if r.Method == "CONNECT" {
 		p.TransferHttps(ctx, w, r)
 	} else {
@@ -93,20 +174,47 @@ func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *ProxyServer) TransferPlainText(ctx *ProxyCtx, w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		if p.Hook != nil {
-			p.Hook(ctx)
-		}
-	}()
+	defer p.runHook(ctx)
 
+	ctx.Request.Method = r.Method
+	ctx.Request.Proto = r.Proto
 	ctx.Request.Host = r.Host
 	ctx.Request.Url = r.URL.String()
 	ctx.Request.Headers = r.Header
-
+	ctx.Request.Bytes.Headers = requestHeaderSize(r)
+	reqBody := countRequestBody(r)
+	p.startSpan(ctx, r)
+
+	// the connection the request goes on, to count its bytes
+	var upstream *countingConn
+	var read0, written0 int64
+	connTrace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			ctx.UpstreamAddr = info.Conn.RemoteAddr().String()
+			if c, ok := info.Conn.(*countingConn); ok {
+				upstream = c
+				read0, written0 = c.Counts()
+			}
+			if c, ok := info.Conn.(*tls.Conn); ok {
+				state := c.ConnectionState()
+				ctx.UpstreamTls = newTlsInfo(&state)
+			}
+		},
+	}
+	traceCtx := httptrace.WithClientTrace(r.Context(), ctx.Timing.clientTrace())
+	r = r.WithContext(httptrace.WithClientTrace(traceCtx, connTrace))
 	res, err := p.Tr.RoundTrip(r)
+	ctx.Request.Bytes.Body = reqBody.Count()
 	if err != nil {
-		zap.S().Errorf("[%v] response from %v error", ctx.Session, r.URL)
-		http.Error(w, "", http.StatusInternalServerError)
+		if r.Context().Err() != nil {
+			// the client went away, nobody to answer
+			ctx.fail(PHASEREQUEST, r.Context().Err())
+			p.logger().Infof("[%v] client aborted the request to %v", ctx.Session, r.URL)
+			return
+		}
+		perr := ctx.fail(roundTripPhase(err), err)
+		p.logger().Errorf("[%v] response from %v error: %v", ctx.Session, r.URL, perr)
+		writeErrorResponse(ctx, w, r.Host, perr)
 		return
 	}
 	// defer res.Body.Close() should not close,
@@ -116,159 +224,333 @@ func (p *ProxyServer) TransferPlainText(ctx *ProxyCtx, w http.ResponseWriter, r
 		}
 	}
 	w.WriteHeader(res.StatusCode)
-	nb, err := io.Copy(w, res.Body)
+	ctx.Response.Headers = res.Header
+	ctx.Response.StatusCode = res.StatusCode
+	nb, phase, err := copyResponse(w, res.Body)
+	ctx.TransferBytes = nb
+	ctx.Request.Bytes.Body = reqBody.Count()
+	ctx.Response.Bytes.Headers = responseHeaderSize(res)
+	ctx.Response.Bytes.Body = nb
+	if upstream != nil {
+		read, written := upstream.Counts()
+		ctx.Request.Bytes.Wire = written - written0
+		ctx.Response.Bytes.Wire = read - read0
+	} else {
+		ctx.Request.Bytes.Wire = ctx.Request.Bytes.Headers + ctx.Request.Bytes.Body
+		ctx.Response.Bytes.Wire = ctx.Response.Bytes.Headers + ctx.Response.Bytes.Body
+	}
 	if err != nil {
-		zap.S().Errorf("[%v] send response back to client failed: %v", ctx.Session, err)
-		http.Error(w, "", res.StatusCode)
+		p.logger().Errorf("[%v] send response back to client failed: %v", ctx.Session, ctx.fail(phase, err))
 		return
 	}
 
-	zap.S().Debugf("[%v] transfer %v bytes", ctx.Session, nb)
-	ctx.TransferBytes = nb
-	ctx.Response.Headers = res.Header
-	ctx.Response.StatusCode = res.StatusCode
+	p.logger().Debugf("[%v] transfer %v bytes", ctx.Session, nb)
 }
 
 func (p *ProxyServer) TransferHttps(ctx *ProxyCtx, w http.ResponseWriter, r *http.Request) {
-	// defer func() {
-	// 	if p.Hook != nil {
-	// 		p.Hook(ctx, r)
-	// 	}
-	// }()
+	// the hook is called for each request served in the tunnel, or once
+	// for the CONNECT itself when none is served (tunnels, failures)
+	hijacked := false
+	defer func() {
+		if ctx.Conn.Requests() == ctx.Seq {
+			p.runHook(ctx)
+		} else {
+			ctx.Timing.finish()
+			p.endSpan(ctx)
+		}
+		// the connection is still served by the http server when it is
+		// not hijacked, its close calls the ConnHook
+		if !hijacked {
+			return
+		}
+		ctx.Conn.End = time.Now()
+		if p.ConnHook != nil {
+			p.ConnHook(ctx.Conn)
+		}
+	}()
 
+	ctx.Request.Method = r.Method
+	ctx.Request.Proto = r.Proto
+	ctx.Request.Host = r.Host
+	ctx.Request.Url = r.URL.String()
+	ctx.Request.Headers = r.Header
 	ctx.Request.Tls = true
+	p.startSpan(ctx, r)
 
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		zap.S().Errorf("[%v] the http server does not support hijacker", ctx.Session)
-		http.Error(w, "", http.StatusInternalServerError)
+		perr := ctx.fail(PHASEHIJACK, errors.New("the http server does not support hijacker"))
+		p.logger().Errorf("[%v] %v", ctx.Session, perr)
+		writeErrorResponse(ctx, w, r.Host, perr)
 		return
 	}
 
-	connFromClient, _, err := hj.Hijack()
+	clientConn, bufrw, err := hj.Hijack()
 	if err != nil {
-		zap.S().Errorf("[%v] fail to hijack the connection: %v", ctx.Session, err)
-		http.Error(w, "", http.StatusInternalServerError)
+		perr := ctx.fail(PHASEHIJACK, err)
+		p.logger().Errorf("[%v] fail to hijack the connection: %v", ctx.Session, perr)
+		writeErrorResponse(ctx, w, r.Host, perr)
 		return
 	}
+	hijacked = true
+	// the client may pipeline bytes right after the CONNECT headers (e.g. an
+	// early ClientHello), they already sit in the hijacked reader
+	connFromClient := newBufferedConn(clientConn, bufrw.Reader)
+	p.metrics.activeTunnels.Inc()
+	defer p.metrics.activeTunnels.Dec()
+	p.tunnels.addConn(connFromClient)
+	defer p.tunnels.removeConn(connFromClient)
 	// should not close, or the mitm proxy server (a goroutine) will use
 	// a close connection
 	// defer connFromClient.Close()
 
 	host := r.URL.Host
-	if !p.Mitm {
-		if !hasPort.MatchString(host) {
-			if r.URL.Scheme == "http" {
-				host += ":80"
-			} else if r.URL.Scheme == "https" {
-				host += ":443"
-			}
+	if !hasPort.MatchString(host) {
+		if r.URL.Scheme == "http" {
+			host += ":80"
+		} else if r.URL.Scheme == "https" {
+			host += ":443"
 		}
-		connToRemote, err := net.DialTimeout("tcp", host, 5*time.Second)
+	}
+	hostname := splitHostname(host)
+	ctx.Conn.Target = host
+	ctx.Conn.settings = p.loadSettings()
+
+	if !p.intercepts(ctx.Conn.settings, hostname) {
+		p.logger().Debugf("[%v] tunnel to %v without interception", ctx.Session, host)
+		defer connFromClient.Close()
+		connToRemote, err := p.dial(ctx, host)
 		if err != nil {
-			zap.S().Errorf("[%v] fail to connect to remote: %v", ctx.Session, err)
-			io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
-			// connToRemote.Close()
+			perr := ctx.fail(PHASEDIAL, err)
+			p.logger().Errorf("[%v] fail to connect to remote: %v", ctx.Session, perr)
+			writeHijackedError(ctx, connFromClient, perr)
 			return
 		}
 		defer connToRemote.Close()
+		p.tunnels.addConn(connToRemote)
+		defer p.tunnels.removeConn(connToRemote)
+		ctx.UpstreamAddr = connToRemote.RemoteAddr().String()
 
 		connFromClient.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		ctx.Response.StatusCode = http.StatusOK
+		p.pipe(ctx, connFromClient, connToRemote)
+		return
+	}
 
-		var wg sync.WaitGroup
-		wg.Add(2)
-		connToRemoteTcp, _ := connToRemote.(*net.TCPConn)
-		connFromClientTcp, _ := connFromClient.(*net.TCPConn)
-		go copyWithWait(ctx, connToRemoteTcp, connFromClientTcp, &wg)
-		go copyWithWait(ctx, connFromClientTcp, connToRemoteTcp, &wg)
-		wg.Wait()
-	} else {
-		addr := r.Host
-		host := strings.Split(addr, ":")[0]
-
-		// get from key cache
-		keypair, err := p.certCache.GetKeyPair(host)
-		if keypair == nil {
-			keypair = &tls.Certificate{}
-		}
-		if err == nil && keypair != nil {
-			zap.S().Debugf("[%v][tls] found one key pair in cache for: %v", ctx.Session, host)
-		}
+	connFromClient.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	ctx.Response.StatusCode = http.StatusOK
+
+	// look at what the client speaks in the tunnel, only tls is intercepted
+	// with a forged certificate
+	conn := connFromClient
+	switch proto := sniffProtocol(conn); proto {
+	case PROTOCOLTLS:
+		p.interceptTls(ctx, conn, hostname)
+	case PROTOCOLHTTP:
+		p.logger().Debugf("[%v] plain http in the tunnel to %v", ctx.Session, host)
+		ctx.Request.Tls = false
+		p.interceptHttp(ctx, conn, host)
+	default:
+		p.logger().Debugf("[%v] unknown protocol in the tunnel to %v, tunnel it", ctx.Session, host)
+		defer conn.Close()
+		connToRemote, err := p.dial(ctx, host)
 		if err != nil {
-			zap.S().Infof("[%v][tls] key not found for %v: %v", ctx.Session, host, err)
-			signedcert, signedkey, err := key.CertificateForKey(host, p.PrivateKey, p.Cert)
-			if err != nil {
-				zap.S().Errorf("[%v][tls] fail to generate a key for: %v, reason: %v", ctx.Session, host, err)
-				http.Error(w, "", http.StatusInternalServerError)
-				return
-			}
+			// the tunnel is already established, only closing is left
+			p.logger().Errorf("[%v] fail to connect to remote: %v", ctx.Session, ctx.fail(PHASEDIAL, err))
+			return
+		}
+		defer connToRemote.Close()
+		p.tunnels.addConn(connToRemote)
+		defer p.tunnels.removeConn(connToRemote)
+		ctx.UpstreamAddr = connToRemote.RemoteAddr().String()
+		p.pipe(ctx, conn, connToRemote)
+	}
+}
 
-			p.certCache.SetKeyPair(host, signedcert.DerBytes, signedkey.PEMEncoded())
-			*keypair, err = tls.X509KeyPair(signedcert.PEMEncoded(), signedkey.PEMEncoded())
+// interceptTls terminates the tls of the client with a forged certificate,
+// and serves the requests inside the tunnel
+func (p *ProxyServer) interceptTls(ctx *ProxyCtx, connFromClient net.Conn, host string) {
+	keypair, err := p.getKeyPair(ctx, host)
+	if err != nil {
+		ctx.fail(PHASECERTIFICATE, err)
+		connFromClient.Close()
+		return
+	}
 
-			if err != nil {
-				zap.S().Errorf("[%v][tls] fail to generate a keypair for: %v", ctx.Session, host)
-				http.Error(w, "", http.StatusInternalServerError)
-				return
-			}
+	settings := ctx.Conn.settings
+	newTlsConfig := settings.clientTlsConfig.Clone()
+	newTlsConfig.Certificates = []tls.Certificate{*keypair}
+	tlsConnFromClient := tls.Server(connFromClient, newTlsConfig)
+	httpsHandler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rctx := newTunnelRequest(ctx)
+		p.logger().Infof("[%v] got request %v in the tunnel of [%v]: %v, %v", rctx.Session, rctx.Seq, ctx.Session, r.Method, r.URL)
+		p.TransferPlainTextToHttpsRemote(rctx, rw, r)
+	})
+
+	// handshake here rather than in the http server, to learn whether
+	// the client accepts our certificate
+	tlsConnFromClient.SetDeadline(time.Now().Add(HANDSHAKETIMEOUT))
+	ctx.Timing.mark(&ctx.Timing.ClientTlsStart)
+	if err := tlsConnFromClient.Handshake(); err != nil {
+		p.tlsLogger().Errorf("[%v][tls] handshake with the client for %v failed: %v", ctx.Session, host, ctx.fail(PHASECLIENTTLS, err))
+		p.metrics.handshakeFailures.Inc()
+		if settings.passthrough != nil && isCertRejection(err) {
+			settings.passthrough.Failed(host)
 		}
+		tlsConnFromClient.Close()
+		return
+	}
+	tlsConnFromClient.SetDeadline(time.Time{})
+	ctx.Timing.mark(&ctx.Timing.ClientTlsDone)
+	state := tlsConnFromClient.ConnectionState()
+	ctx.Conn.Mitm = true
+	ctx.Conn.Tls = &state
+	ctx.ClientTls = newTlsInfo(&state)
+	if settings.passthrough != nil {
+		settings.passthrough.Succeeded(host)
+	}
 
-		newTlsConfig := &tls.Config{
-			CipherSuites:             p.TlsConfig.CipherSuites,
-			PreferServerCipherSuites: p.TlsConfig.PreferServerCipherSuites,
-			InsecureSkipVerify:       p.TlsConfig.InsecureSkipVerify,
-			Certificates:             []tls.Certificate{*keypair},
+	p.serveConn(tlsConnFromClient, httpsHandler)
+}
+
+// interceptHttp serves the plain http requests sent in a tunnel, e.g. a
+// CONNECT to port 80
+func (p *ProxyServer) interceptHttp(ctx *ProxyCtx, connFromClient net.Conn, host string) {
+	ctx.Conn.Mitm = true
+	httpHandler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// requests in a tunnel use the origin form, rebuild the absolute url
+		r.URL.Scheme = "http"
+		if r.URL.Host = r.Host; r.URL.Host == "" {
+			r.URL.Host = host
 		}
-		tlsConnFromClient := tls.Server(connFromClient, newTlsConfig)
-		httpsListener := &HttpsListener{conn: tlsConnFromClient}
-		httpsHandler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-			p.TransferPlainTextToHttpsRemote(ctx, rw, r)
-		})
+		rctx := newTunnelRequest(ctx)
+		p.logger().Infof("[%v] got request %v in the tunnel of [%v]: %v, %v", rctx.Session, rctx.Seq, ctx.Session, r.Method, r.URL)
+		p.TransferPlainText(rctx, rw, r)
+	})
 
-		connFromClient.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	p.serveConn(connFromClient, httpHandler)
+}
 
-		singleServ := p.newSingleUseTlsServer()
-		defer p.fakeServerPool.Put(singleServ)
-		singleServ.Handler = httpsHandler
-		singleServ.Serve(httpsListener)
+// getKeyPair returns the leaf key pair for host from the cache, or issues a
+// new one. Concurrent requests for the same host share a single lookup, so
+// the cache counts one hit or one miss for them.
+func (p *ProxyServer) getKeyPair(ctx *ProxyCtx, host string) (*tls.Certificate, error) {
+	keypair, err, shared := p.certFlight.Do(host, func() (*tls.Certificate, error) {
+		keypair, err := p.certCache.GetKeyPair(host)
+		if err == nil {
+			p.tlsLogger().Debugf("[%v][tls] found one key pair in cache for: %v", ctx.Session, host)
+			return keypair, nil
+		}
+		p.tlsLogger().Infof("[%v][tls] key not found for %v: %v", ctx.Session, host, err)
+
+		start := time.Now()
+		leaf, err := p.KeyPool.Get()
+		if err != nil {
+			p.tlsLogger().Errorf("[%v][tls] fail to generate a key for: %v, reason: %v", ctx.Session, host, err)
+			return nil, err
+		}
+		cacert, cakey := p.CA()
+		keypair, err = keycache.IssueKeyPair(p.certCache, host, leaf, cakey, cacert)
+		p.metrics.observeLeafGeneration(time.Since(start))
+		if keypair == nil {
+			p.tlsLogger().Errorf("[%v][tls] fail to generate a keypair for: %v, reason: %v", ctx.Session, host, err)
+			return nil, err
+		}
+		if err != nil {
+			p.tlsLogger().Errorf("[%v][tls] fail to store the key pair for: %v, reason: %v", ctx.Session, host, err)
+		}
+		return keypair, nil
+	})
+	if shared {
+		p.tlsLogger().Debugf("[%v][tls] shared key pair lookup for: %v", ctx.Session, host)
 	}
+
+	return keypair, err
 }
 
 func (p *ProxyServer) TransferPlainTextToHttpsRemote(ctx *ProxyCtx, w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		if p.Hook != nil {
-			p.Hook(ctx)
-		}
-	}()
+	defer p.runHook(ctx)
 
+	ctx.Request.Method = r.Method
+	ctx.Request.Proto = r.Proto
 	ctx.Request.Host = r.Host
 	ctx.Request.Url = r.URL.String()
 	ctx.Request.Headers = r.Header
+	if r.TLS != nil {
+		ctx.Request.ClientCertificates = r.TLS.PeerCertificates
+	}
+	ctx.Request.Bytes.Headers = requestHeaderSize(r)
+	reqBody := countRequestBody(r)
+	p.startSpan(ctx, r)
 
 	host := r.Host
 	if !hasPort.MatchString(host) {
 		host += ":443"
 	}
-	connRemote, err := tls.Dial("tcp", host, p.TlsConfig)
+	serverName := splitHostname(r.Host)
+	// the answer must reach the client before the write timeout of the tunnel
+	// server, so dial and handshake share one deadline
+	deadline := time.Now().Add(DIALTIMEOUT)
+	dialCtx, cancel := context.WithDeadline(httptrace.WithClientTrace(r.Context(), ctx.Timing.clientTrace()), deadline)
+	defer cancel()
+	tcpRemote, err := p.dialer.DialContext(dialCtx, "tcp", host)
 	if err != nil {
-		zap.S().Errorf("[%v][tls] fail to dial to : %v, reason: %v", ctx.Session, host, err)
-		http.Error(w, "", http.StatusInternalServerError)
+		perr := ctx.fail(PHASEDIAL, err)
+		p.tlsLogger().Errorf("[%v][tls] fail to dial to : %v, reason: %v", ctx.Session, host, perr)
+		writeErrorResponse(ctx, w, serverName, perr)
 		return
 	}
+	ctx.UpstreamAddr = tcpRemote.RemoteAddr().String()
+	settings := ctx.Conn.settings
+	if settings == nil {
+		settings = p.loadSettings()
+	}
+	connRemote := tls.Client(tcpRemote, settings.upstreamTls.configFor(serverName))
 	defer connRemote.Close()
+	p.tunnels.addConn(tcpRemote)
+	defer p.tunnels.removeConn(tcpRemote)
+	connRemote.SetDeadline(deadline)
+	ctx.Timing.mark(&ctx.Timing.UpstreamTlsStart)
+	if err := connRemote.Handshake(); err != nil {
+		perr := ctx.fail(PHASEUPSTREAMTLS, err)
+		p.tlsLogger().Errorf("[%v][tls] fail to handshake with : %v, reason: %v", ctx.Session, host, perr)
+		writeErrorResponse(ctx, w, serverName, perr)
+		return
+	}
+	connRemote.SetDeadline(time.Time{})
+	ctx.Timing.mark(&ctx.Timing.UpstreamTlsDone)
+	upstreamState := connRemote.ConnectionState()
+	ctx.UpstreamTls = newTlsInfo(&upstreamState)
+	counted := &countingConn{Conn: connRemote}
+	defer func() {
+		read, written := counted.Counts()
+		ctx.Request.Bytes.Body = reqBody.Count()
+		ctx.Request.Bytes.Wire = written
+		ctx.Response.Bytes.Wire = read
+	}()
 
 	// remove some headers
 	p.removeHeaders(r)
-	if err = r.Write(connRemote); err != nil {
-		zap.S().Errorf("[%v][tls] fail to send request to : %v, reason: %v", ctx.Session, host, err)
-		http.Error(w, "", http.StatusInternalServerError)
+	if err = r.Write(counted); err != nil {
+		perr := ctx.fail(PHASEREQUEST, err)
+		p.tlsLogger().Errorf("[%v][tls] fail to send request to : %v, reason: %v", ctx.Session, host, perr)
+		writeErrorResponse(ctx, w, serverName, perr)
 		return
 	}
+	ctx.Timing.mark(&ctx.Timing.RequestSent)
 
-	respRemote, err := http.ReadResponse(bufio.NewReader(connRemote), r)
-	if err != nil && err != io.EOF {
-		zap.S().Errorf("[%v][tls] fail to read response from : %v, reason: %v", ctx.Session, host, err)
-		http.Error(w, "", http.StatusInternalServerError)
+	br := bufio.NewReader(counted)
+	if _, err := br.Peek(1); err == nil {
+		ctx.Timing.mark(&ctx.Timing.FirstByte)
+	}
+	respRemote, err := http.ReadResponse(br, r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		perr := ctx.fail(PHASERESPONSE, err)
+		p.tlsLogger().Errorf("[%v][tls] fail to read response from : %v, reason: %v", ctx.Session, host, perr)
+		writeErrorResponse(ctx, w, serverName, perr)
 		return
 	}
 
@@ -280,26 +562,68 @@ func (p *ProxyServer) TransferPlainTextToHttpsRemote(ctx *ProxyCtx, w http.Respo
 	// Force connection close otherwise chrome will keep CONNECT tunnel open forever
 	respRemote.Header.Set("Connection", "close")
 	w.WriteHeader(respRemote.StatusCode)
-	nb, err := io.Copy(w, respRemote.Body)
+	ctx.Response.Headers = respRemote.Header
+	ctx.Response.StatusCode = respRemote.StatusCode
+	nb, phase, err := copyResponse(w, respRemote.Body)
+	ctx.TransferBytes = nb
+	ctx.Response.Bytes.Headers = responseHeaderSize(respRemote)
+	ctx.Response.Bytes.Body = nb
 	if err != nil {
-		zap.S().Errorf("[%v][tls] send response back to client failed: %v", ctx.Session, err)
-		http.Error(w, "", respRemote.StatusCode)
+		p.tlsLogger().Errorf("[%v][tls] send response back to client failed: %v", ctx.Session, ctx.fail(phase, err))
 		return
 	}
 	// defer respRemote.Body.Close() should NOT close, or tls connection will break
-	zap.S().Debugf("[%v][tls] transfer %v bytes", ctx.Session, nb)
-	ctx.TransferBytes = nb
-	ctx.Response.Headers = respRemote.Header
-	ctx.Response.StatusCode = respRemote.StatusCode
+	p.tlsLogger().Debugf("[%v][tls] transfer %v bytes", ctx.Session, nb)
 }
 
-func copyWithWait(ctx *ProxyCtx, dst, src *net.TCPConn, wg *sync.WaitGroup) {
-	nb, err := io.Copy(dst, src)
-	if err != nil && nb == 0 {
-		zap.S().Errorf("[%v] transfer encountering error: %v", ctx.Session, err)
+// runHook completes the timing and reports ctx to the metrics, the tracer,
+// the access log and the hook
+func (p *ProxyServer) runHook(ctx *ProxyCtx) {
+	ctx.Timing.finish()
+	p.metrics.observe(ctx)
+	p.endSpan(ctx)
+	if p.accessLog != nil {
+		p.accessLog.Log(ctx)
+	}
+	if p.Hook != nil {
+		p.Hook(ctx)
+	}
+}
+
+// dial connects to the upstream of a tunnel, recording the dns and connect timing
+func (p *ProxyServer) dial(ctx *ProxyCtx, host string) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(httptrace.WithClientTrace(context.Background(), ctx.Timing.clientTrace()), DIALTIMEOUT)
+	defer cancel()
+	return p.dialer.DialContext(dialCtx, "tcp", host)
+}
+
+// pipe copies between the client and the remote until both sides are done,
+// the bytes of each direction are the wire bytes of the request and response
+func (p *ProxyServer) pipe(ctx *ProxyCtx, client, remote net.Conn) {
+	var wg sync.WaitGroup
+	var up, down int64
+	wg.Add(2)
+	go p.copyWithWait(ctx, remote, client, &up, &wg)
+	go p.copyWithWait(ctx, client, remote, &down, &wg)
+	wg.Wait()
+	ctx.Request.Bytes.Wire = up
+	ctx.Response.Bytes.Wire = down
+	ctx.TransferBytes = down
+	p.logger().Debugf("[%v] tunnel transfer %v bytes up, %v bytes down", ctx.Session, up, down)
+}
+
+func (p *ProxyServer) copyWithWait(ctx *ProxyCtx, dst, src net.Conn, nb *int64, wg *sync.WaitGroup) {
+	var err error
+	*nb, err = io.Copy(dst, src)
+	if err != nil && *nb == 0 {
+		p.logger().Errorf("[%v] transfer encountering error: %v", ctx.Session, err)
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	if cr, ok := src.(interface{ CloseRead() error }); ok {
+		cr.CloseRead()
 	}
-	dst.CloseWrite()
-	src.CloseRead()
 	wg.Done()
 }
 
@@ -330,6 +654,24 @@ func (p *ProxyServer) removeHeaders(r *http.Request) {
 	r.Header.Del("Connection")
 }
 
+// serveConn serves the requests of a single connection, and returns once the
+// connection is closed. Serve itself returns as soon as the connection is accepted.
+func (p *ProxyServer) serveConn(conn net.Conn, handler http.Handler) {
+	closed := make(chan struct{})
+	singleServ := p.newSingleUseTlsServer()
+	singleServ.Handler = handler
+	singleServ.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			close(closed)
+		}
+	}
+	p.tunnels.addServer(singleServ)
+	singleServ.Serve(&HttpsListener{conn: conn})
+	<-closed
+	p.tunnels.removeServer(singleServ)
+	p.fakeServerPool.Put(singleServ)
+}
+
 func (p *ProxyServer) newSingleUseTlsServer() *http.Server {
 	fake := p.fakeServerPool.Get().(*http.Server)
 	fake.ReadTimeout = 10 * time.Second
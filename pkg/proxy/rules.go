@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	ACTIONMITM   = "mitm"
+	ACTIONTUNNEL = "tunnel"
+)
+
+// MitmRules decide per CONNECT whether the mitm proxy intercepts the
+// tunnel or passes it through untouched. A pattern is one of
+//
+//	example.com       the exact host, or ip (2001:db8::1 or [2001:db8::1])
+//	*.example.com     any sub domain of example.com
+//	*                 any host
+//	re:^api\d+\.      a case-insensitive regular expression on the host
+//	10.0.0.0/8        the hosts given as an ip in the network, names are not resolved
+//
+// Tunnel patterns win over mitm patterns, Default applies if none matches.
+type MitmRules struct {
+	// Default is mitm or tunnel, empty means mitm
+	Default string   `json:"default" yaml:"default"`
+	Mitm    []string `json:"mitm" yaml:"mitm"`
+	Tunnel  []string `json:"tunnel" yaml:"tunnel"`
+}
+
+// LoadMitmRules reads json mitm rules
+func LoadMitmRules(filename string) (*MitmRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rules := &MitmRules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("parse mitm rules %v failed: %v", filename, err)
+	}
+	return rules, nil
+}
+
+// hostMatcher is a compiled host pattern
+type hostMatcher struct {
+	pattern string
+	re      *regexp.Regexp
+	ipnet   *net.IPNet
+	ip      net.IP
+}
+
+func newHostMatcher(pattern string) (*hostMatcher, error) {
+	m := &hostMatcher{pattern: strings.ToLower(pattern)}
+	switch {
+	case strings.HasPrefix(pattern, "re:"):
+		// hosts are matched lowercased, so is the regexp
+		re, err := regexp.Compile("(?i)" + strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host regexp %v: %v", pattern, err)
+		}
+		m.re = re
+	case strings.Contains(pattern, "/"):
+		_, ipnet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host cidr %v: %v", pattern, err)
+		}
+		m.ipnet = ipnet
+	case pattern == "":
+		return nil, fmt.Errorf("empty host pattern")
+	default:
+		// an ip matches however it is written
+		m.ip = net.ParseIP(strings.Trim(pattern, "[]"))
+	}
+	return m, nil
+}
+
+func (m *hostMatcher) Match(host string) bool {
+	switch {
+	case m.re != nil:
+		return m.re.MatchString(host)
+	case m.ipnet != nil:
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		return ip != nil && m.ipnet.Contains(ip)
+	case m.ip != nil:
+		return m.ip.Equal(net.ParseIP(strings.Trim(host, "[]")))
+	case m.pattern == "*":
+		return true
+	default:
+		return matchHostPattern(m.pattern, host)
+	}
+}
+
+func newHostMatchers(patterns []string) ([]*hostMatcher, error) {
+	matchers := make([]*hostMatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		m, err := newHostMatcher(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func matchAny(matchers []*hostMatcher, host string) bool {
+	for _, m := range matchers {
+		if m.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// mitmRules is the compiled form of MitmRules
+type mitmRules struct {
+	intercept bool
+	mitm      []*hostMatcher
+	tunnel    []*hostMatcher
+}
+
+func (r *MitmRules) build() (*mitmRules, error) {
+	rules := &mitmRules{}
+	switch strings.ToLower(r.Default) {
+	case "", ACTIONMITM:
+		rules.intercept = true
+	case ACTIONTUNNEL:
+		rules.intercept = false
+	default:
+		return nil, fmt.Errorf("unknown mitm default action: %v", r.Default)
+	}
+
+	var err error
+	if rules.mitm, err = newHostMatchers(r.Mitm); err != nil {
+		return nil, err
+	}
+	if rules.tunnel, err = newHostMatchers(r.Tunnel); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Intercept tells whether the CONNECT to host should be intercepted
+func (r *mitmRules) Intercept(host string) bool {
+	host = strings.ToLower(host)
+	if matchAny(r.tunnel, host) {
+		return false
+	}
+	if matchAny(r.mitm, host) {
+		return true
+	}
+	return r.intercept
+}
+
+// SetMitmRules validates and applies the rules for the new CONNECTs
+func (p *ProxyServer) SetMitmRules(r *MitmRules) error {
+	rules, err := r.build()
+	if err != nil {
+		return err
+	}
+	p.updateSettings(func(s *proxySettings) {
+		s.mitmRules = rules
+	})
+	return nil
+}
+
+// intercepts tells whether the CONNECT to host goes through the mitm proxy
+func (p *ProxyServer) intercepts(s *proxySettings, host string) bool {
+	if !p.Mitm {
+		return false
+	}
+	if s.passthrough != nil && s.passthrough.Active(host) {
+		return false
+	}
+	return s.mitmRules == nil || s.mitmRules.Intercept(host)
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSplitHostname(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.com:443", "example.com"},
+		{"example.com", "example.com"},
+		{"10.1.2.3:443", "10.1.2.3"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		if got := splitHostname(tt.host); got != tt.want {
+			t.Errorf("splitHostname(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMitmRulesIntercept(t *testing.T) {
+	rules, err := (&MitmRules{
+		Default: ACTIONTUNNEL,
+		Mitm: []string{
+			"example.com",
+			"*.example.org",
+			`re:^api\d+\.example\.net$`,
+			`re:^CDN\.Example\.io$`,
+			"10.0.0.0/8",
+			"2001:db8::/32",
+			"192.168.1.1",
+			"[fd00::1]",
+		},
+		Tunnel: []string{"secure.example.org", "10.9.0.0/16", "2001:db8:ffff::/48"},
+	}).build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		// exact
+		{"example.com:443", true},
+		{"EXAMPLE.com:443", true},
+		{"www.example.com:443", false},
+		{"192.168.1.1:443", true},
+		{"192.168.1.2:443", false},
+		{"[fd00::1]:443", true},
+		{"[fd00:0:0::1]:443", true},
+		{"[fd00::2]:443", false},
+		// wildcard
+		{"a.example.org:443", true},
+		{"a.b.example.org:443", true},
+		{"example.org:443", false},
+		{"secure.example.org:443", false},
+		// regex
+		{"api12.example.net:443", true},
+		{"api.example.net:443", false},
+		{"API7.Example.NET:443", true},
+		{"cdn.example.io:443", true},
+		{"Cdn.EXAMPLE.io:443", true},
+		// cidr
+		{"10.1.2.3:443", true},
+		{"10.9.1.1:443", false},
+		{"11.1.2.3:443", false},
+		{"[2001:db8::1]:443", true},
+		{"[2001:db8:ffff::1]:443", false},
+		{"[2001:db9::1]:443", false},
+	}
+	for _, tt := range tests {
+		if got := rules.Intercept(splitHostname(tt.target)); got != tt.want {
+			t.Errorf("Intercept(%v) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestMitmRulesDefault(t *testing.T) {
+	tests := []struct {
+		rules MitmRules
+		want  bool
+	}{
+		{MitmRules{}, true},
+		{MitmRules{Default: "MITM"}, true},
+		{MitmRules{Default: ACTIONTUNNEL}, false},
+		{MitmRules{Default: ACTIONTUNNEL, Mitm: []string{"*"}}, true},
+		{MitmRules{Mitm: []string{"*"}, Tunnel: []string{"example.com"}}, false},
+	}
+	for _, tt := range tests {
+		rules, err := tt.rules.build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rules.Intercept("example.com"); got != tt.want {
+			t.Errorf("%+v: Intercept = %v, want %v", tt.rules, got, tt.want)
+		}
+	}
+}
+
+func TestMitmRulesBuildErrors(t *testing.T) {
+	tests := []MitmRules{
+		{Default: "drop"},
+		{Mitm: []string{""}},
+		{Mitm: []string{"re:("}},
+		{Tunnel: []string{"10.0.0.0/33"}},
+	}
+	for _, rules := range tests {
+		if _, err := rules.build(); err == nil {
+			t.Errorf("%+v was accepted", rules)
+		}
+	}
+}
+
+func TestTunnelRuleKeepsTheUpstreamCertificate(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	p, _, _ := newTestMitmServer(t)
+	if err := p.SetMitmRules(&MitmRules{Tunnel: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	res, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v", res.Status)
+	}
+	if !res.TLS.PeerCertificates[0].Equal(upstream.Certificate()) {
+		t.Fatalf("the tunnel was intercepted, got a leaf of %v", res.TLS.PeerCertificates[0].Issuer)
+	}
+}
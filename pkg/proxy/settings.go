@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// proxySettings are the parts of a mitm proxy a reload swaps as a whole. A
+// tunnel keeps the settings it was opened with until it is closed.
+type proxySettings struct {
+	clientTlsConfig *tls.Config
+	upstreamTls     *upstreamTls
+	mitmRules       *mitmRules
+	passthrough     *passthroughTracker
+}
+
+// loadSettings returns the settings for the new tunnels
+func (p *ProxyServer) loadSettings() *proxySettings {
+	s, _ := p.settings.Load().(*proxySettings)
+	if s == nil {
+		return &proxySettings{}
+	}
+	return s
+}
+
+// updateSettings stores a modified copy of the settings, the tunnels opened
+// before keep the previous ones
+func (p *ProxyServer) updateSettings(update func(s *proxySettings)) {
+	p.settingsMu.Lock()
+	defer p.settingsMu.Unlock()
+	s := *p.loadSettings()
+	update(&s)
+	p.settings.Store(&s)
+}
+
+// ApplyConfig validates the reloadable parts of a config, the tls policy,
+// the upstream tls, the rules, the auto tunnel and the CA, and switches to
+// all of them at once. Nothing is changed on error. The listeners, the
+// mode and the cache need a new ProxyServer.
+func (p *ProxyServer) ApplyConfig(c *Config) error {
+	if !p.Mitm {
+		return nil
+	}
+	clientTlsConfig, err := c.Tls.Config()
+	if err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	ut, err := c.Upstream.build()
+	if err != nil {
+		return fmt.Errorf("upstream: %v", err)
+	}
+	rules, err := c.Rules.build()
+	if err != nil {
+		return fmt.Errorf("rules: %v", err)
+	}
+	cert, pk, err := loadCA(c.CA.Cert, c.CA.Key)
+	if err != nil {
+		return fmt.Errorf("ca: %v", err)
+	}
+
+	// everything is valid, the settings, the paths and the CA are switched
+	// under one lock so another reload can not interleave
+	ttl := time.Duration(c.AutoTunnel.TTL)
+	p.settingsMu.Lock()
+	defer p.settingsMu.Unlock()
+	s := *p.loadSettings()
+	s.clientTlsConfig = clientTlsConfig
+	s.upstreamTls = ut
+	s.mitmRules = rules
+	// the hosts already tunnelled stay so, unless the policy changed
+	if s.passthrough == nil || s.passthrough.threshold != c.AutoTunnel.After || s.passthrough.ttl != ttl {
+		s.passthrough = nil
+		if c.AutoTunnel.After > 0 {
+			s.passthrough = newPassthroughTracker(c.AutoTunnel.After, ttl, p.tlsLogger)
+		}
+	}
+	p.settings.Store(&s)
+	p.caCertPath, p.caKeyPath = c.CA.Cert, c.CA.Key
+	if current, _ := p.CA(); current.Fingerprint() != cert.Fingerprint() {
+		p.switchCA(cert, pk)
+	}
+	return nil
+}
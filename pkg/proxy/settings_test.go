@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"xiaolongbaoproxy/pkg/keycache"
+)
+
+// reloadConfig is the config of p as created by newFileCAMitmServer
+func reloadConfig(p *ProxyServer) *Config {
+	c := DefaultConfig()
+	c.CA = CAConfig{Cert: p.caCertPath, Key: p.caKeyPath}
+	c.Cache.Store = keycache.MEMSCHEME
+	return c
+}
+
+func TestApplyConfig(t *testing.T) {
+	p, _ := newFileCAMitmServer(t)
+	c := reloadConfig(p)
+	c.Rules.Tunnel = []string{"tunnel.test"}
+	if err := p.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if p.intercepts(p.loadSettings(), "tunnel.test") || !p.intercepts(p.loadSettings(), "mitm.test") {
+		t.Error("the rules are not applied")
+	}
+
+	// the auto tunnel state survives a reload with the same policy
+	tracker := p.loadSettings().passthrough
+	c.Upstream.InsecureHosts = []string{"127.0.0.1"}
+	if err := p.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if p.loadSettings().passthrough != tracker {
+		t.Error("the auto tunnel state is reset by an unrelated change")
+	}
+	c.AutoTunnel.After++
+	if err := p.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.loadSettings(); s.passthrough == tracker || s.passthrough.threshold != c.AutoTunnel.After {
+		t.Error("the auto tunnel policy is not applied")
+	}
+	c.AutoTunnel.After = 0
+	if err := p.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if p.loadSettings().passthrough != nil {
+		t.Error("the auto tunnel is not disabled")
+	}
+}
+
+func TestApplyInvalidConfig(t *testing.T) {
+	p, oldCert := newFileCAMitmServer(t)
+	certPath, keyPath := p.caCertPath, p.caKeyPath
+	before := p.loadSettings()
+	// each config also switches to a valid CA, which must not be used
+	newCert, newPk := newTestCA(t)
+	newDir := newTempDir(t)
+	_, otherPk := newTestCA(t)
+	tests := []struct {
+		name   string
+		change func(*Config)
+		err    string
+	}{
+		{"tls", func(c *Config) { c.Tls.MinVersion = "1.4" }, "tls: "},
+		{"upstream", func(c *Config) { c.Upstream.RootCAs = []string{"missing.pem"} }, "upstream: "},
+		{"rules", func(c *Config) { c.Rules.Default = "drop" }, "rules: "},
+		{"ca", func(c *Config) { c.CA.Cert = "missing.crt" }, "ca: "},
+		{"mismatched ca", func(c *Config) {
+			c.CA.Cert, c.CA.Key = writeTestCA(t, newTempDir(t), newCert.PEMEncoded(), otherPk.PEMEncoded())
+		}, "ca: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := reloadConfig(p)
+			c.Rules.Tunnel = []string{"tunnel.test"}
+			c.CA.Cert, c.CA.Key = writeTestCA(t, newDir, newCert.PEMEncoded(), newPk.PEMEncoded())
+			tt.change(c)
+			if err := p.ApplyConfig(c); err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Fatalf("got %v, want a %v error", err, tt.err)
+			}
+			if p.loadSettings() != before {
+				t.Error("the settings changed on error")
+			}
+			if current, _ := p.CA(); current.Fingerprint() != oldCert.Fingerprint() {
+				t.Error("the CA changed on error")
+			}
+			if p.caCertPath != certPath || p.caKeyPath != keyPath {
+				t.Errorf("the CA paths changed on error to %v, %v", p.caCertPath, p.caKeyPath)
+			}
+		})
+	}
+}
+
+func TestApplyConfigSwitchesTheCA(t *testing.T) {
+	p, _ := newFileCAMitmServer(t)
+	cert, pk := newTestCA(t)
+	c := reloadConfig(p)
+	c.CA.Cert, c.CA.Key = writeTestCA(t, newTempDir(t), cert.PEMEncoded(), pk.PEMEncoded())
+	if err := p.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := p.CA(); current.Fingerprint() != cert.Fingerprint() {
+		t.Error("the CA of the config is not used")
+	}
+	// a later reload reads the new files
+	if p.caCertPath != c.CA.Cert || p.caKeyPath != c.CA.Key {
+		t.Errorf("CA paths %v, %v", p.caCertPath, p.caKeyPath)
+	}
+}
+
+func TestConcurrentReloadsKeepTheCAOfThePaths(t *testing.T) {
+	p, _ := newFileCAMitmServer(t)
+	for i := 0; i < 10; i++ {
+		cert, pk := newTestCA(t)
+		c := reloadConfig(p)
+		c.CA.Cert, c.CA.Key = writeTestCA(t, newTempDir(t), cert.PEMEncoded(), pk.PEMEncoded())
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := p.ApplyConfig(c); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := p.ReloadCA(); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		// a reload reading the previous paths must not switch back
+		if current, _ := p.CA(); current.Fingerprint() != cert.Fingerprint() {
+			t.Fatalf("round %v: the CA is not the one at %v", i, p.caCertPath)
+		}
+	}
+}
+
+func TestOpenTunnelKeepsItsSettings(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	p, ca := newFileCAMitmServer(t)
+	c := reloadConfig(p)
+	c.Upstream.InsecureHosts = []string{"127.0.0.1"}
+	if err := p.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	newClient := func() *http.Client {
+		return &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+	get := func(client *http.Client) int {
+		res, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	opened := newClient()
+	if status := get(opened); status != http.StatusOK {
+		t.Fatalf("got %v", status)
+	}
+	// the upstream certificate is verified from now on
+	c.Upstream.InsecureHosts = nil
+	if err := p.ApplyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if status := get(opened); status != http.StatusOK {
+		t.Errorf("the open tunnel got %v, want the settings it was opened with", status)
+	}
+	if status := get(newClient()); status != http.StatusBadGateway {
+		t.Errorf("a new tunnel got %v, want the reloaded settings", status)
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// SHUTDOWNTIMEOUT is the default time given to the tunnels to drain
+	SHUTDOWNTIMEOUT = 30 * time.Second
+	// SHUTDOWNPOLLINTERVAL is how often Shutdown checks whether the tunnels
+	// are drained
+	SHUTDOWNPOLLINTERVAL = 100 * time.Millisecond
+)
+
+// tunnelTracker keeps the connections hijacked for the tunnels, which the
+// http server no longer sees, so a shutdown can wait for them or close them
+type tunnelTracker struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	servers  map[*http.Server]struct{}
+	draining bool
+}
+
+func newTunnelTracker() *tunnelTracker {
+	return &tunnelTracker{
+		conns:   make(map[net.Conn]struct{}),
+		servers: make(map[*http.Server]struct{}),
+	}
+}
+
+func (t *tunnelTracker) addConn(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[conn] = struct{}{}
+}
+
+func (t *tunnelTracker) removeConn(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+}
+
+// addServer tracks the server of an intercepted tunnel, it does not keep
+// the connection alive once the proxy is draining
+func (t *tunnelTracker) addServer(srv *http.Server) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	srv.SetKeepAlivesEnabled(!t.draining)
+	t.servers[srv] = struct{}{}
+}
+
+func (t *tunnelTracker) removeServer(srv *http.Server) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.servers, srv)
+}
+
+// drain closes the intercepted tunnels once their current request is served
+func (t *tunnelTracker) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	for srv := range t.servers {
+		srv.SetKeepAlivesEnabled(false)
+	}
+}
+
+func (t *tunnelTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *tunnelTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// Shutdown drains the tunnels: the intercepted ones are closed after their
+// current request, the others when either side closes them. The tunnels
+// still open when ctx is done are closed, and its error is returned. The
+// listeners are left to the caller, e.g. http.Server.Shutdown, which does
+// not see the hijacked connections.
+func (p *ProxyServer) Shutdown(ctx context.Context) error {
+	p.tunnels.drain()
+	ticker := time.NewTicker(SHUTDOWNPOLLINTERVAL)
+	defer ticker.Stop()
+	for {
+		n := p.tunnels.count()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			p.logger().Warnf("closing %v tunnel connections not drained in time", n)
+			p.tunnels.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close releases what the proxy opened, the cert cache above all, once it
+// is shut down. The access log and the tracer provider belong to the caller.
+func (p *ProxyServer) Close() error {
+	p.Tr.CloseIdleConnections()
+	if p.KeyPool != nil {
+		p.KeyPool.Close()
+	}
+	if p.sweeper != nil {
+		p.sweeper.Stop()
+	}
+	if p.certCache != nil {
+		return p.certCache.Close()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShutdownWithoutTunnels(t *testing.T) {
+	p := NewProxyServer(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+}
+
+func TestShutdownClosesTunnelsOnTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	p := NewProxyServer(nil)
+	conn := dialProxy(t, p)
+	fmt.Fprint(conn, connectRequest(echo))
+	r := bufio.NewReader(conn)
+	readConnectResponse(t, r)
+	for p.tunnels.count() != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a plain tunnel only ends when a side closes it
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want the deadline exceeded", err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("the tunnel is still open: %v", err)
+	}
+}
+
+func TestShutdownDrainsMitmTunnels(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	newClient := func() *http.Client {
+		return &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	// an idle tunnel, and one serving a request
+	idle := newClient()
+	res, err := idle.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	slow := make(chan *http.Response, 1)
+	go func() {
+		res, err := newClient().Get(upstream.URL + "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		slow <- res
+	}()
+	for p.tunnels.count() < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- p.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+
+	if res := <-slow; res == nil || res.StatusCode != http.StatusOK || !res.Close {
+		t.Errorf("the request in flight got %v, want a 200 closing the tunnel", res)
+	} else {
+		res.Body.Close()
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown = %v, want the tunnels drained", err)
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"time"
+)
+
+const (
+	PROTOCOLTLS     = "tls"
+	PROTOCOLHTTP    = "http"
+	PROTOCOLUNKNOWN = "unknown"
+)
+
+// SNIFFTIMEOUT is how long to wait for the client to speak first in a
+// CONNECT tunnel, protocols where the server speaks first are tunnelled
+const SNIFFTIMEOUT = 5 * time.Second
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "), []byte("CONNECT "),
+}
+
+// bufferedConn is a connection whose first bytes may already be read into r,
+// reads drain r before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn, r *bufio.Reader) *bufferedConn {
+	if r == nil {
+		r = bufio.NewReader(conn)
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half closes the underlying connection if it supports it
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// CloseRead half closes the underlying connection if it supports it
+func (c *bufferedConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+// sniffProtocol peeks at the first bytes the client sends in the tunnel
+func sniffProtocol(conn *bufferedConn) string {
+	conn.SetReadDeadline(time.Now().Add(SNIFFTIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// a tls record header: handshake type, then version 3.x
+	head, err := conn.r.Peek(3)
+	if err != nil {
+		return PROTOCOLUNKNOWN
+	}
+	if head[0] == 0x16 && head[1] == 0x03 && head[2] <= 0x04 {
+		return PROTOCOLTLS
+	}
+
+	// the longest method is "OPTIONS ", a shorter message is checked as is
+	head, err = conn.r.Peek(len("OPTIONS "))
+	if err != nil {
+		head, _ = conn.r.Peek(conn.r.Buffered())
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(head, method) {
+			return PROTOCOLHTTP
+		}
+	}
+	return PROTOCOLUNKNOWN
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	tests := []struct {
+		name  string
+		first []byte
+		want  string
+	}{
+		{"tls client hello", []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x00}, PROTOCOLTLS},
+		{"tls 1.0 record version", []byte{0x16, 0x03, 0x00, 0x00}, PROTOCOLTLS},
+		{"get", []byte("GET / HTTP/1.1\r\nHost: example.test\r\n\r\n"), PROTOCOLHTTP},
+		{"options", []byte("OPTIONS * HTTP/1.1\r\n\r\n"), PROTOCOLHTTP},
+		{"short method", []byte("PUT "), PROTOCOLHTTP},
+		{"ssh", []byte("SSH-2.0-OpenSSH\r\n"), PROTOCOLUNKNOWN},
+		{"not a handshake record", []byte{0x17, 0x03, 0x03, 0x00}, PROTOCOLUNKNOWN},
+		{"lower case method", []byte("get / HTTP/1.1\r\n\r\n"), PROTOCOLUNKNOWN},
+		{"hang up", nil, PROTOCOLUNKNOWN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(tt.first)
+				client.Close()
+			}()
+
+			conn := newBufferedConn(server, nil)
+			if got := sniffProtocol(conn); got != tt.want {
+				t.Errorf("sniffProtocol = %v, want %v", got, tt.want)
+			}
+			// the sniffed bytes are still read from the connection
+			rest, _ := ioutil.ReadAll(conn)
+			if !bytes.Equal(rest, tt.first) {
+				t.Errorf("read %q after sniffing, want %q", rest, tt.first)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyTiming records when each step of a request happened, a step which did
+// not happen (e.g. dns for a reused connection) stays zero. Nothing is
+// recorded once Done is set, so the hooks can read it.
+type ProxyTiming struct {
+	Received         time.Time
+	DNSStart         time.Time
+	DNSDone          time.Time
+	ConnectStart     time.Time
+	ConnectDone      time.Time
+	ClientTlsStart   time.Time
+	ClientTlsDone    time.Time
+	UpstreamTlsStart time.Time
+	UpstreamTlsDone  time.Time
+	RequestSent      time.Time
+	FirstByte        time.Time
+	Done             time.Time
+	// mu guards the steps, the dials report them from their own goroutines,
+	// possibly after the request is done
+	mu sync.Mutex
+}
+
+// mark sets the step to now, only the first occurrence is kept
+func (t *ProxyTiming) mark(step *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Done.IsZero() && step.IsZero() {
+		*step = time.Now()
+	}
+}
+
+// finish sets Done, the steps reported later are ignored
+func (t *ProxyTiming) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Done.IsZero() {
+		t.Done = time.Now()
+	}
+}
+
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+func (t *ProxyTiming) DNS() time.Duration {
+	return since(t.DNSStart, t.DNSDone)
+}
+
+func (t *ProxyTiming) Connect() time.Duration {
+	return since(t.ConnectStart, t.ConnectDone)
+}
+
+func (t *ProxyTiming) ClientTls() time.Duration {
+	return since(t.ClientTlsStart, t.ClientTlsDone)
+}
+
+func (t *ProxyTiming) UpstreamTls() time.Duration {
+	return since(t.UpstreamTlsStart, t.UpstreamTlsDone)
+}
+
+// Wait is the time from the request sent to the first response byte
+func (t *ProxyTiming) Wait() time.Duration {
+	return since(t.RequestSent, t.FirstByte)
+}
+
+// Total is the time from the request received to the response completed
+func (t *ProxyTiming) Total() time.Duration {
+	return since(t.Received, t.Done)
+}
+
+// String lists the non zero durations, e.g. "dns=2ms connect=1ms total=12ms"
+func (t *ProxyTiming) String() string {
+	steps := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dns", t.DNS()},
+		{"connect", t.Connect()},
+		{"client_tls", t.ClientTls()},
+		{"upstream_tls", t.UpstreamTls()},
+		{"wait", t.Wait()},
+		{"total", t.Total()},
+	}
+	var parts []string
+	for _, s := range steps {
+		if s.d > 0 {
+			parts = append(parts, fmt.Sprintf("%v=%v", s.name, s.d.Round(time.Microsecond)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// clientTrace records the steps of a dial or a transport round trip
+func (t *ProxyTiming) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.mark(&t.DNSStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.mark(&t.DNSDone) },
+		// happy eyeballs may race several dials, keep the first start
+		// and the first success
+		ConnectStart: func(string, string) { t.mark(&t.ConnectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				t.mark(&t.ConnectDone)
+			}
+		},
+		TLSHandshakeStart: func() { t.mark(&t.UpstreamTlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				t.mark(&t.UpstreamTlsDone)
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.RequestSent) },
+		GotFirstResponseByte: func() { t.mark(&t.FirstByte) },
+	}
+}
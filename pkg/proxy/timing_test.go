@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyTimingString(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	timing := &ProxyTiming{
+		Received:     at(0),
+		ConnectStart: at(1),
+		ConnectDone:  at(3),
+		RequestSent:  at(4),
+		FirstByte:    at(9),
+		Done:         at(12),
+		// a step without its end is not reported
+		UpstreamTlsStart: at(3),
+	}
+	if got, want := timing.String(), "connect=2ms wait=5ms total=12ms"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if timing.DNS() != 0 || timing.UpstreamTls() != 0 {
+		t.Errorf("missing steps have a duration: %v", timing)
+	}
+}
+
+func TestMarkKeepsTheFirst(t *testing.T) {
+	timing := &ProxyTiming{}
+	timing.mark(&timing.ConnectStart)
+	first := timing.ConnectStart
+	time.Sleep(time.Millisecond)
+	timing.mark(&timing.ConnectStart)
+	if timing.ConnectStart != first {
+		t.Error("mark overwrote the first occurrence")
+	}
+}
+
+func TestMitmRequestTiming(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctxs := make(chan *ProxyCtx, 1)
+	p.Hook = func(ctx *ProxyCtx) { ctxs <- ctx }
+
+	if res, _ := mitmGet(t, p, ca, strings.TrimPrefix(upstream.URL, "https://")); res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v", res.Status)
+	}
+	timing := &(<-ctxs).Timing
+	for name, d := range map[string]time.Duration{
+		"connect":      timing.Connect(),
+		"client tls":   timing.ClientTls(),
+		"upstream tls": timing.UpstreamTls(),
+		"wait":         timing.Wait(),
+		"total":        timing.Total(),
+	} {
+		if d <= 0 {
+			t.Errorf("%v was not recorded: %v", name, timing.String())
+		}
+	}
+	if timing.DNS() != 0 {
+		t.Errorf("dns recorded for an ip: %v", timing.String())
+	}
+}
+
+func TestTimingConcurrentDials(t *testing.T) {
+	ctx := NewProxyCtx()
+	trace := ctx.Timing.clientTrace()
+
+	// happy eyeballs: the primary and the fallback dials report at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trace.DNSStart(httptrace.DNSStartInfo{})
+			trace.DNSDone(httptrace.DNSDoneInfo{})
+			trace.ConnectStart("tcp", "127.0.0.1:443")
+			trace.ConnectDone("tcp", "127.0.0.1:443", nil)
+		}()
+	}
+	wg.Wait()
+	if ctx.Timing.ConnectStart.IsZero() || ctx.Timing.ConnectDone.IsZero() {
+		t.Errorf("connect not recorded: %+v", ctx.Timing.String())
+	}
+}
+
+func TestTimingIgnoresStepsAfterDone(t *testing.T) {
+	ctx := NewProxyCtx()
+	trace := ctx.Timing.clientTrace()
+
+	// a dial of the transport outlives the request
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		close(started)
+		for i := 0; i < 100; i++ {
+			trace.ConnectStart("tcp", "127.0.0.1:443")
+			trace.ConnectDone("tcp", "127.0.0.1:443", nil)
+			trace.GotFirstResponseByte()
+		}
+	}()
+	<-started
+	ctx.Timing.finish()
+	// what a hook does
+	_ = ctx.Timing.String()
+	connectDone := ctx.Timing.ConnectDone
+	<-done
+
+	if ctx.Timing.ConnectDone != connectDone {
+		t.Error("a step was recorded after Done")
+	}
+	if !ctx.Timing.ConnectDone.IsZero() && ctx.Timing.ConnectDone.After(ctx.Timing.Done) {
+		t.Error("a step is later than Done")
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+)
+
+// TlsInfo describes the tls of one leg of a request, towards the client or
+// towards the upstream
+type TlsInfo struct {
+	// Version is e.g. TLS 1.3
+	Version     string
+	CipherSuite string
+	// ALPN is the negotiated protocol, empty when none
+	ALPN string
+	// ServerName is the SNI sent by the client of the leg
+	ServerName string
+	// PeerCertificates is the chain presented by the peer, the leaf first
+	PeerCertificates []*x509.Certificate
+}
+
+func newTlsInfo(cs *tls.ConnectionState) *TlsInfo {
+	if cs == nil {
+		return nil
+	}
+	return &TlsInfo{
+		Version:          tls.VersionName(cs.Version),
+		CipherSuite:      tls.CipherSuiteName(cs.CipherSuite),
+		ALPN:             cs.NegotiatedProtocol,
+		ServerName:       cs.ServerName,
+		PeerCertificates: cs.PeerCertificates,
+	}
+}
+
+// proxyUser is the user of a Basic Proxy-Authorization. The proxy does not
+// check the credentials, it is the identity claimed by the client.
+func proxyUser(r *http.Request) string {
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return ""
+	}
+	// reuse the parsing of the Authorization header
+	req := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	user, _, ok := req.BasicAuth()
+	if !ok {
+		return ""
+	}
+	return user
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProxyUser(t *testing.T) {
+	basic := func(s string) string { return "Basic " + base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name string
+		auth string
+		user string
+	}{
+		{"none", "", ""},
+		{"basic", basic("alice:secret"), "alice"},
+		{"empty password", basic("bob:"), "bob"},
+		{"not basic", "Bearer token", ""},
+		{"malformed", "Basic !!!", ""},
+		{"no colon", basic("carol"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://example.test/", nil)
+			if tt.auth != "" {
+				r.Header.Set("Proxy-Authorization", tt.auth)
+			}
+			if got := proxyUser(r); got != tt.user {
+				t.Errorf("proxyUser = %q, want %q", got, tt.user)
+			}
+		})
+	}
+}
+
+func TestMitmTlsInfo(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	target := strings.TrimPrefix(upstream.URL, "https://")
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctxs := make(chan *ProxyCtx, 1)
+	p.Hook = func(ctx *ProxyCtx) { ctxs <- ctx }
+
+	if res, _ := mitmGet(t, p, ca, target); res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v", res.Status)
+	}
+	ctx := <-ctxs
+	if ctx.ClientTls == nil || ctx.UpstreamTls == nil {
+		t.Fatalf("client tls %v, upstream tls %v", ctx.ClientTls, ctx.UpstreamTls)
+	}
+	if ctx.ClientTls.Version != "TLS 1.3" || ctx.ClientTls.CipherSuite == "" {
+		t.Errorf("client tls %+v", ctx.ClientTls)
+	}
+	if ctx.UpstreamTls.Version != "TLS 1.3" || ctx.UpstreamTls.CipherSuite == "" {
+		t.Errorf("upstream tls %+v", ctx.UpstreamTls)
+	}
+	certs := ctx.UpstreamTls.PeerCertificates
+	if len(certs) == 0 || !certs[0].Equal(upstream.Certificate()) {
+		t.Error("the upstream certificate is not reported")
+	}
+	if ctx.UpstreamAddr != target {
+		t.Errorf("UpstreamAddr = %v, want %v", ctx.UpstreamAddr, target)
+	}
+}
+
+func TestPlainRequestHasNoTlsInfo(t *testing.T) {
+	if newTlsInfo(nil) != nil {
+		t.Error("newTlsInfo(nil) is not nil")
+	}
+	ctx := NewProxyCtx()
+	if ctx.ClientTls != nil || ctx.UpstreamTls != nil {
+		t.Error("a new ctx has tls info")
+	}
+}
+
+func TestConnectProxyUser(t *testing.T) {
+	echo := startEchoServer(t)
+	rec := newConnRecorder()
+	p := NewProxyServer(nil)
+	p.ConnHook = rec.connHook
+
+	conn := dialProxy(t, p)
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\nProxy-Authorization: Basic %v\r\n\r\n", echo, echo, auth)
+	conn.Close()
+
+	if user := rec.waitClosed(t).ProxyUser; user != "alice" {
+		t.Errorf("ProxyUser = %q, want alice", user)
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TlsPolicy describes the tls settings offered to the clients of the mitm proxy
+type TlsPolicy struct {
+	// MinVersion and MaxVersion are one of 1.0, 1.1, 1.2, 1.3
+	MinVersion string `json:"min_version" yaml:"min_version"`
+	MaxVersion string `json:"max_version" yaml:"max_version"`
+	// CipherSuites are the names from crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	// empty means the go defaults. They do not apply to tls 1.3.
+	CipherSuites []string `json:"cipher_suites" yaml:"cipher_suites"`
+	// Curves are X25519, P256, P384 or P521, empty means the go defaults
+	Curves []string `json:"curves" yaml:"curves"`
+	// ALPN are the protocols offered to the client, h2 or http/1.1
+	ALPN           []string `json:"alpn" yaml:"alpn"`
+	SessionTickets bool     `json:"session_tickets" yaml:"session_tickets"`
+	// ClientAuth asks the clients for a certificate: none, request or require.
+	// The certificate is not verified, it is reported in the ProxyCtx.
+	ClientAuth string `json:"client_auth" yaml:"client_auth"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":        tls.NoClientCert,
+	"none":    tls.NoClientCert,
+	"request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert,
+}
+
+var alpnProtocols = map[string]bool{
+	"h2":       true,
+	"http/1.1": true,
+}
+
+// DefaultTlsPolicy only allows tls 1.2 and above with the go default
+// (AEAD, forward secret) cipher suites
+func DefaultTlsPolicy() *TlsPolicy {
+	return &TlsPolicy{
+		MinVersion:     "1.2",
+		MaxVersion:     "1.3",
+		ALPN:           []string{"http/1.1"},
+		SessionTickets: true,
+		ClientAuth:     "none",
+	}
+}
+
+// LoadTlsPolicy reads a json policy, the unset fields keep the defaults
+func LoadTlsPolicy(filename string) (*TlsPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tp := DefaultTlsPolicy()
+	if err := json.Unmarshal(data, tp); err != nil {
+		return nil, fmt.Errorf("parse tls policy %v failed: %v", filename, err)
+	}
+	return tp, nil
+}
+
+func parseTlsVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(v), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version: %v", v)
+	}
+	return version, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+	}
+	insecure := make(map[string]bool)
+	for _, c := range tls.InsecureCipherSuites() {
+		insecure[c.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			if insecure[name] {
+				return nil, fmt.Errorf("insecure cipher suite is not allowed: %v", name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite: %v", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Config validates the policy and builds the tls config for the client side,
+// the certificates are set per connection
+func (tp *TlsPolicy) Config() (*tls.Config, error) {
+	minVersion, err := parseTlsVersion(tp.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	maxVersion, err := parseTlsVersion(tp.MaxVersion)
+	if err != nil {
+		return nil, err
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return nil, fmt.Errorf("tls min version %v is above max version %v", tp.MinVersion, tp.MaxVersion)
+	}
+
+	ciphers, err := parseCipherSuites(tp.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	var curves []tls.CurveID
+	for _, name := range tp.Curves {
+		curve, ok := tlsCurves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %v", name)
+		}
+		curves = append(curves, curve)
+	}
+
+	for _, proto := range tp.ALPN {
+		if !alpnProtocols[proto] {
+			return nil, fmt.Errorf("unsupported alpn protocol: %v", proto)
+		}
+	}
+
+	clientAuth, ok := clientAuthTypes[strings.ToLower(tp.ClientAuth)]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth: %v", tp.ClientAuth)
+	}
+
+	return &tls.Config{
+		ClientAuth:             clientAuth,
+		MinVersion:             minVersion,
+		MaxVersion:             maxVersion,
+		CipherSuites:           ciphers,
+		CurvePreferences:       curves,
+		NextProtos:             tp.ALPN,
+		SessionTicketsDisabled: !tp.SessionTickets,
+	}, nil
+}
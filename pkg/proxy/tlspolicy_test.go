@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTlsPolicyConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  TlsPolicy
+		want    *tls.Config
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			policy: *DefaultTlsPolicy(),
+			want: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				MaxVersion: tls.VersionTLS13,
+				NextProtos: []string{"http/1.1"},
+			},
+		},
+		{
+			name: "everything set",
+			policy: TlsPolicy{
+				MinVersion:   "TLS1.1",
+				MaxVersion:   "1.2",
+				CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+				Curves:       []string{"x25519", "P256"},
+				ALPN:         []string{"h2", "http/1.1"},
+				ClientAuth:   "require",
+			},
+			want: &tls.Config{
+				MinVersion:             tls.VersionTLS11,
+				MaxVersion:             tls.VersionTLS12,
+				CipherSuites:           []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				CurvePreferences:       []tls.CurveID{tls.X25519, tls.CurveP256},
+				NextProtos:             []string{"h2", "http/1.1"},
+				SessionTicketsDisabled: true,
+				ClientAuth:             tls.RequireAnyClientCert,
+			},
+		},
+		{name: "unknown version", policy: TlsPolicy{MinVersion: "1.4"}, wantErr: true},
+		{name: "min above max", policy: TlsPolicy{MinVersion: "1.3", MaxVersion: "1.2"}, wantErr: true},
+		{name: "unknown cipher", policy: TlsPolicy{CipherSuites: []string{"TLS_FOO"}}, wantErr: true},
+		{name: "insecure cipher", policy: TlsPolicy{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, wantErr: true},
+		{name: "unknown curve", policy: TlsPolicy{Curves: []string{"P224"}}, wantErr: true},
+		{name: "unknown client auth", policy: TlsPolicy{ClientAuth: "verify"}, wantErr: true},
+		{name: "unsupported alpn", policy: TlsPolicy{ALPN: []string{"spdy/3"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.Config()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("the policy was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTlsPolicyKeepsDefaults(t *testing.T) {
+	filename := filepath.Join(newTempDir(t), "policy.json")
+	if err := ioutil.WriteFile(filename, []byte(`{"min_version": "1.3"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tp, err := LoadTlsPolicy(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultTlsPolicy()
+	want.MinVersion = "1.3"
+	if !reflect.DeepEqual(tp, want) {
+		t.Fatalf("policy = %+v, want %+v", tp, want)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(`{"min_version": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTlsPolicy(filename); err == nil {
+		t.Fatal("a broken policy was loaded")
+	}
+}
+
+func TestSetTlsPolicyRejectsInvalid(t *testing.T) {
+	p, _, _ := newTestMitmServer(t)
+	if err := p.SetTlsPolicy(&TlsPolicy{MinVersion: "1.4"}); err == nil {
+		t.Fatal("an invalid policy was set")
+	}
+}
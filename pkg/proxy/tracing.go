@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TRACERNAME is the instrumentation name of the spans of the proxy
+const TRACERNAME = "xiaolongbaoproxy/pkg/proxy"
+
+// the proxy only speaks w3c trace context
+var traceContext = propagation.TraceContext{}
+
+// NewOtlpTracerProvider exports the spans to an otlp/http collector, e.g.
+// localhost:4318, sampling ratio of the traces started by the proxy. The
+// traces started upstream of the proxy follow their own sampling decision.
+func NewOtlpTracerProvider(endpoint string, insecure bool, ratio float64) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceNameKey.String("xiaolongbaoproxy"))),
+	), nil
+}
+
+// SetTracerProvider turns each proxied request into a span, a nil provider
+// disables tracing
+func (p *ProxyServer) SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	p.tracer = tp.Tracer(TRACERNAME)
+}
+
+// startSpan starts the span of the request of ctx as a child of the trace
+// context sent by the client, or of the tunnel span, and injects it in the
+// headers sent upstream
+func (p *ProxyServer) startSpan(ctx *ProxyCtx, r *http.Request) {
+	parent := ctx.traceCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	parent = traceContext.Extract(parent, propagation.HeaderCarrier(r.Header))
+	ctx.traceCtx, ctx.span = p.tracer.Start(parent, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(ctx.Timing.Received))
+	traceContext.Inject(ctx.traceCtx, propagation.HeaderCarrier(r.Header))
+}
+
+// endSpan ends the span of ctx, the steps recorded in its timing become
+// child spans
+func (p *ProxyServer) endSpan(ctx *ProxyCtx) {
+	span := ctx.span
+	if span == nil {
+		return
+	}
+	ctx.span = nil
+	if !span.IsRecording() {
+		span.End()
+		return
+	}
+
+	t := &ctx.Timing
+	child := func(name string, kind trace.SpanKind, start, end time.Time) {
+		if start.IsZero() || end.IsZero() {
+			return
+		}
+		_, s := p.tracer.Start(ctx.traceCtx, name, trace.WithSpanKind(kind), trace.WithTimestamp(start))
+		s.End(trace.WithTimestamp(end))
+	}
+	child("dns", trace.SpanKindInternal, t.DNSStart, t.DNSDone)
+	child("connect", trace.SpanKindInternal, t.ConnectStart, t.ConnectDone)
+	// the client handshake belongs to the span of the tunnel, which is not
+	// the first request of a keep-alive connection
+	if ctx.tunnel == nil {
+		child("tls client", trace.SpanKindInternal, t.ClientTlsStart, t.ClientTlsDone)
+	}
+	child("tls upstream", trace.SpanKindInternal, t.UpstreamTlsStart, t.UpstreamTlsDone)
+	if !t.RequestSent.IsZero() {
+		// from the connection ready, or reused, to the response completed
+		ready := t.Received
+		for _, step := range []time.Time{t.ConnectDone, t.UpstreamTlsDone} {
+			if step.After(ready) {
+				ready = step
+			}
+		}
+		child("upstream round trip", trace.SpanKindClient, ready, t.Done)
+	}
+
+	span.SetAttributes(
+		semconv.HTTPMethodKey.String(ctx.Request.Method),
+		semconv.HTTPURLKey.String(ctx.Request.Url),
+		semconv.HTTPHostKey.String(ctx.Request.Host),
+		semconv.HTTPStatusCodeKey.Int(ctx.Response.StatusCode),
+		attribute.String("proxy.client", ctx.Conn.ClientAddr),
+		attribute.Int64("proxy.session", ctx.Session),
+		attribute.Int64("proxy.conn", ctx.Conn.Id),
+		attribute.Bool("proxy.mitm", ctx.Conn.Mitm),
+		attribute.String("proxy.upstream", ctx.UpstreamAddr),
+		attribute.Int64("proxy.request.bytes", ctx.Request.Bytes.Wire),
+		attribute.Int64("proxy.response.bytes", ctx.Response.Bytes.Wire),
+	)
+	if ctx.Error != nil {
+		span.SetAttributes(
+			attribute.String("proxy.error.kind", string(ctx.Error.Kind)),
+			attribute.String("proxy.error.phase", ctx.Error.Phase),
+		)
+		span.SetStatus(codes.Error, ctx.Error.Error())
+	} else if ctx.Response.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(ctx.Response.StatusCode))
+	}
+	span.End(trace.WithTimestamp(t.Done))
+}
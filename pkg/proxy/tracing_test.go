@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// spanNamed returns the last ended span called name
+func spanNamed(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	var span sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == name {
+			span = s
+		}
+	}
+	return span
+}
+
+// childrenOf returns the names of the ended children of span
+func childrenOf(recorder *tracetest.SpanRecorder, span sdktrace.ReadOnlySpan) map[string]bool {
+	children := make(map[string]bool)
+	for _, s := range recorder.Ended() {
+		if s.Parent().SpanID() == span.SpanContext().SpanID() {
+			children[s.Name()] = true
+		}
+	}
+	return children
+}
+
+func TestMitmTracingSpans(t *testing.T) {
+	traceparent := make(chan string, 1)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "https://")
+
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	rec := newConnRecorder()
+	p.ConnHook = rec.connHook
+	recorder := tracetest.NewSpanRecorder()
+	p.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	res, err := (&http.Client{Transport: tr}).Get("https://" + target + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	// the span of the tunnel ends with it
+	tr.CloseIdleConnections()
+	rec.waitClosed(t)
+
+	request, tunnel := spanNamed(recorder, "GET"), spanNamed(recorder, "CONNECT")
+	if request == nil || tunnel == nil {
+		t.Fatalf("spans: request %v, tunnel %v", request != nil, tunnel != nil)
+	}
+	if request.Parent().SpanID() != tunnel.SpanContext().SpanID() {
+		t.Error("the request span is not a child of the tunnel span")
+	}
+	children := childrenOf(recorder, request)
+	for _, name := range []string{"connect", "tls upstream", "upstream round trip"} {
+		if !children[name] {
+			t.Errorf("no %q child span, got %v", name, children)
+		}
+	}
+	if children["tls client"] || !childrenOf(recorder, tunnel)["tls client"] {
+		t.Error("the client handshake is not a child of the tunnel span")
+	}
+
+	select {
+	case got := <-traceparent:
+		// 00-<trace id>-<span id>-<flags>
+		parts := strings.Split(got, "-")
+		if len(parts) != 4 || parts[1] != request.SpanContext().TraceID().String() || parts[2] != request.SpanContext().SpanID().String() {
+			t.Errorf("traceparent sent upstream %q, want trace %v span %v", got,
+				request.SpanContext().TraceID(), request.SpanContext().SpanID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream got no request")
+	}
+}
+
+func TestTunnelAfterKeepAliveRequestTracesTheClientTls(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	upstream := startTlsUpstream(t)
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	rec := newConnRecorder()
+	p.ConnHook = rec.connHook
+	recorder := tracetest.NewSpanRecorder()
+	p.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	conn, err := net.Dial("tcp", startConfiguredProxy(t, p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	// the tunnel is the second request of the connection
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+	fmt.Fprintf(conn, "GET %v/ HTTP/1.1\r\nHost: %v\r\n\r\n", plain.URL, plainHost)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	fmt.Fprint(conn, connectRequest(strings.TrimPrefix(upstream.URL, "https://")))
+	readConnectResponse(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: roots})
+	req, _ := http.NewRequest("GET", upstream.URL+"/", nil)
+	if err := req.Write(tlsConn); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = http.ReadResponse(bufio.NewReader(tlsConn), req); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	conn.Close()
+	rec.waitClosed(t)
+
+	request, tunnel := spanNamed(recorder, "GET"), spanNamed(recorder, "CONNECT")
+	if request == nil || tunnel == nil {
+		t.Fatalf("spans: request %v, tunnel %v", request != nil, tunnel != nil)
+	}
+	if request.Parent().SpanID() != tunnel.SpanContext().SpanID() {
+		t.Fatal("the last GET is not the request in the tunnel")
+	}
+	if childrenOf(recorder, request)["tls client"] || !childrenOf(recorder, tunnel)["tls client"] {
+		t.Error("the client handshake is not a child of the tunnel span")
+	}
+}
+
+func TestPlainTracingFollowsTheClientTrace(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	hooked := make(chan struct{}, 1)
+	p := NewProxyServer(func(*ProxyCtx) { hooked <- struct{}{} })
+	recorder := tracetest.NewSpanRecorder()
+	p.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r, _ := http.NewRequest("GET", upstream.URL+"/", nil)
+	r.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	res, err := (&http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}).Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	<-hooked
+
+	span := spanNamed(recorder, "GET")
+	if span == nil {
+		t.Fatal("no span for the request")
+	}
+	if span.SpanContext().TraceID().String() != traceId || span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("span trace %v parent %v, want the trace of the client", span.SpanContext().TraceID(), span.Parent().SpanID())
+	}
+	if span.Status().Code.String() != "Error" {
+		t.Errorf("a 502 span has status %v", span.Status().Code)
+	}
+}
+
+// startOtlpReceiver serves the otlp/http traces endpoint and sends the
+// requests it receives to exports
+func startOtlpReceiver(t *testing.T, exports chan<- *coltracepb.ExportTraceServiceRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(raw, req); err != nil {
+			t.Errorf("unmarshal export: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		exports <- req
+		res, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(res)
+	}))
+}
+
+func TestOtlpTracerProviderExports(t *testing.T) {
+	exports := make(chan *coltracepb.ExportTraceServiceRequest, 16)
+	receiver := startOtlpReceiver(t, exports)
+	defer receiver.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	tp, err := NewOtlpTracerProvider(strings.TrimPrefix(receiver.URL, "http://"), true, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooked := make(chan struct{}, 1)
+	p := NewProxyServer(func(*ProxyCtx) { hooked <- struct{}{} })
+	p.SetTracerProvider(tp)
+	proxySrv := httptest.NewServer(p)
+	defer proxySrv.Close()
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+
+	res, err := (&http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}).Get(upstream.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	<-hooked
+	// the batcher exports the ended spans on shutdown
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	close(exports)
+	var service string
+	spans := map[string]bool{}
+	for req := range exports {
+		for _, rs := range req.ResourceSpans {
+			for _, attr := range rs.GetResource().GetAttributes() {
+				if attr.Key == "service.name" {
+					service = attr.GetValue().GetStringValue()
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span.Name] = true
+				}
+			}
+		}
+	}
+	if !spans["GET"] {
+		t.Errorf("exported spans %v, want the GET span", spans)
+	}
+	if service != "xiaolongbaoproxy" {
+		t.Errorf("exported service name %q", service)
+	}
+}
+
+func TestNoopTracing(t *testing.T) {
+	p := NewProxyServer(nil)
+	ctx := NewProxyCtx()
+	r := httptest.NewRequest("GET", "http://example.test/", nil)
+	p.startSpan(ctx, r)
+	if ctx.span == nil || ctx.span.IsRecording() {
+		t.Error("the span of a proxy without tracer is recorded")
+	}
+	p.endSpan(ctx)
+	if ctx.span != nil {
+		t.Error("the span is kept after its end")
+	}
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const connectEstablished = "HTTP/1.1 200 Connection Established\r\n\r\n"
+
+// startEchoServer echoes everything it reads on each connection
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// dialProxy opens a client connection to the proxy p
+func dialProxy(t *testing.T, p *ProxyServer) net.Conn {
+	t.Helper()
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func connectRequest(target string) string {
+	return fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+}
+
+// readConnectResponse reads the answer to the CONNECT, the bytes after it
+// stay in r
+func readConnectResponse(t *testing.T, r *bufio.Reader) {
+	t.Helper()
+	got := make([]byte, len(connectEstablished))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != connectEstablished {
+		t.Fatalf("CONNECT answered %q", got)
+	}
+}
+
+func TestMitmUnknownProtocolIsTunnelled(t *testing.T) {
+	echo := startEchoServer(t)
+	p, _, _ := newTestMitmServer(t)
+
+	conn := dialProxy(t, p)
+	if _, err := io.WriteString(conn, connectRequest(echo)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	readConnectResponse(t, r)
+
+	greeting := "SSH-2.0-test\r\n"
+	if _, err := io.WriteString(conn, greeting); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(greeting))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != greeting {
+		t.Fatalf("the echo server answered %q", got)
+	}
+}
+
+func TestMitmHttpInTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v", r.Method, r.URL.Path)
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "http://")
+	p, _, _ := newTestMitmServer(t)
+	ctxs := make(chan *ProxyCtx, 1)
+	p.Hook = func(ctx *ProxyCtx) { ctxs <- ctx }
+
+	conn := dialProxy(t, p)
+	if _, err := io.WriteString(conn, connectRequest(target)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	readConnectResponse(t, r)
+
+	req, _ := http.NewRequest("GET", "/path", nil)
+	req.Host = target
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "GET /path" {
+		t.Fatalf("got %q", body)
+	}
+
+	ctx := <-ctxs
+	if ctx.Request.Tls || ctx.Request.Url != upstream.URL+"/path" {
+		t.Fatalf("the request was recorded as %+v", ctx.Request)
+	}
+}
+
+// testPayload is large enough to span many reads, and has no repeating
+// pattern so a reordering shows up
+func testPayload() []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < 256*1024; i++ {
+		fmt.Fprintf(&b, "%08d|", i)
+	}
+	return b.Bytes()
+}
+
+// pipelineTunnel writes the CONNECT and the first bytes of the tunnel in a
+// single write, and checks they come back from the echo server unchanged
+func pipelineTunnel(t *testing.T, p *ProxyServer, target string, first []byte) {
+	conn := dialProxy(t, p)
+	payload := testPayload()
+	go func() {
+		conn.Write(append([]byte(connectRequest(target)), first...))
+		conn.Write(payload)
+	}()
+
+	r := bufio.NewReader(conn)
+	readConnectResponse(t, r)
+	want := append(append([]byte{}, first...), payload...)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("the tunnel lost or reordered the bytes sent with the CONNECT")
+	}
+}
+
+func TestPipelinedConnectTunnel(t *testing.T) {
+	echo := startEchoServer(t)
+	pipelineTunnel(t, NewProxyServer(nil), echo, []byte("SSH-2.0-early\r\n"))
+}
+
+func TestPipelinedConnectMitmUnknownProtocol(t *testing.T) {
+	echo := startEchoServer(t)
+	p, _, _ := newTestMitmServer(t)
+	pipelineTunnel(t, p, echo, []byte("SSH-2.0-early\r\n"))
+}
+
+func TestPipelinedConnectMitmRuleTunnel(t *testing.T) {
+	echo := startEchoServer(t)
+	p, _, _ := newTestMitmServer(t)
+	if err := p.SetMitmRules(&MitmRules{Tunnel: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	// a client hello which is never intercepted
+	pipelineTunnel(t, p, echo, []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x00})
+}
+
+// pipelinedConn sends the CONNECT with the first write of the client, and
+// reads its answer before the first read
+type pipelinedConn struct {
+	net.Conn
+	t       *testing.T
+	connect []byte
+	r       *bufio.Reader
+}
+
+func (c *pipelinedConn) Write(b []byte) (int, error) {
+	if c.connect != nil {
+		data := append(c.connect, b...)
+		c.connect = nil
+		if _, err := c.Conn.Write(data); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *pipelinedConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		c.r = bufio.NewReader(c.Conn)
+		readConnectResponse(c.t, c.r)
+	}
+	return c.r.Read(b)
+}
+
+func TestPipelinedConnectMitmTls(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server stops reading the body once the answer is written
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "https://")
+	p, ca, _ := newTestMitmServer(t)
+	if err := p.SetUpstreamTls(&UpstreamTls{InsecureHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialProxy(t, p)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	// the ClientHello goes in the same write as the CONNECT
+	tlsConn := tls.Client(&pipelinedConn{Conn: conn, t: t, connect: []byte(connectRequest(target))}, &tls.Config{
+		ServerName: "127.0.0.1",
+		RootCAs:    roots,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := testPayload()
+	r := bufio.NewReader(tlsConn)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", upstream.URL+"/", bytes.NewReader(payload))
+		go req.Write(tlsConn)
+		res, err := http.ReadResponse(r, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, payload) {
+			t.Fatalf("request %v: the body came back changed, %v bytes instead of %v", i, len(body), len(payload))
+		}
+	}
+}
+
+func TestPipelinedConnectMitmHttp(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v", r.Method, r.URL.Path)
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "http://")
+	p, _, _ := newTestMitmServer(t)
+
+	conn := dialProxy(t, p)
+	// the CONNECT and two pipelined requests in one write
+	var data bytes.Buffer
+	data.WriteString(connectRequest(target))
+	for _, path := range []string{"/first", "/second"} {
+		fmt.Fprintf(&data, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", path, target)
+	}
+	if _, err := conn.Write(data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	readConnectResponse(t, r)
+	for _, path := range []string{"/first", "/second"} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if want := "GET " + path; !strings.HasPrefix(string(body), want) {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// UpstreamTls describes how the mitm proxy verifies the upstream servers,
+// independently from the tls policy offered to the clients
+type UpstreamTls struct {
+	// RootCAs are PEM bundles trusted in addition to the system roots
+	RootCAs []string `json:"root_cas" yaml:"root_cas"`
+	// NoSystemRoots only trusts RootCAs
+	NoSystemRoots bool `json:"no_system_roots" yaml:"no_system_roots"`
+	// InsecureHosts are host patterns (see MitmRules) whose certificate
+	// is not verified, e.g. self-signed staging servers
+	InsecureHosts []string `json:"insecure_hosts" yaml:"insecure_hosts"`
+	// Pins maps a host pattern to the sha256 fingerprints of the certificates
+	// accepted for it, one of the presented chain must match
+	Pins map[string][]string `json:"pins" yaml:"pins"`
+	// ClientCerts are presented to the upstream servers requiring mutual tls
+	ClientCerts []ClientCert `json:"client_certs" yaml:"client_certs"`
+}
+
+// ClientCert is a client certificate for the upstream hosts matching Host
+type ClientCert struct {
+	// Host is a host pattern, see MitmRules
+	Host string `json:"host" yaml:"host"`
+	Cert string `json:"cert" yaml:"cert"`
+	Key  string `json:"key" yaml:"key"`
+}
+
+// LoadUpstreamTls reads a json upstream tls description
+func LoadUpstreamTls(filename string) (*UpstreamTls, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	u := &UpstreamTls{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, fmt.Errorf("parse upstream tls %v failed: %v", filename, err)
+	}
+	return u, nil
+}
+
+// upstreamTls is the validated form of UpstreamTls
+type upstreamTls struct {
+	roots       *x509.CertPool
+	insecure    []*hostMatcher
+	pins        []pin
+	clientCerts []clientCert
+}
+
+type pin struct {
+	matcher      *hostMatcher
+	fingerprints map[string]bool
+}
+
+type clientCert struct {
+	matcher *hostMatcher
+	keypair tls.Certificate
+}
+
+func (u *UpstreamTls) build() (*upstreamTls, error) {
+	insecure, err := newHostMatchers(u.InsecureHosts)
+	if err != nil {
+		return nil, err
+	}
+	ut := &upstreamTls{insecure: insecure}
+
+	if len(u.RootCAs) > 0 || u.NoSystemRoots {
+		roots := x509.NewCertPool()
+		if !u.NoSystemRoots {
+			system, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, fmt.Errorf("load system roots failed: %v", err)
+			}
+			roots = system
+		}
+		for _, bundle := range u.RootCAs {
+			data, err := ioutil.ReadFile(bundle)
+			if err != nil {
+				return nil, err
+			}
+			if !roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in %v", bundle)
+			}
+		}
+		ut.roots = roots
+	}
+
+	// sort the patterns so overlapping pins always resolve the same way
+	patterns := make([]string, 0, len(u.Pins))
+	for pattern := range u.Pins {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		fps := u.Pins[pattern]
+		matcher, err := newHostMatcher(pattern)
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[string]bool)
+		for _, fp := range fps {
+			fp = strings.ToLower(strings.Replace(fp, ":", "", -1))
+			if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid sha256 fingerprint for %v: %v", pattern, fp)
+			}
+			set[fp] = true
+		}
+		ut.pins = append(ut.pins, pin{matcher: matcher, fingerprints: set})
+	}
+
+	for _, cc := range u.ClientCerts {
+		matcher, err := newHostMatcher(cc.Host)
+		if err != nil {
+			return nil, err
+		}
+		keypair, err := tls.LoadX509KeyPair(cc.Cert, cc.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate for %v failed: %v", cc.Host, err)
+		}
+		ut.clientCerts = append(ut.clientCerts, clientCert{matcher: matcher, keypair: keypair})
+	}
+	return ut, nil
+}
+
+// matchHostPattern matches a host against example.com or *.example.com
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// PinError is returned when no certificate of the upstream chain matches the pins
+type PinError struct {
+	Host string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("the certificate of %v does not match the pinned fingerprints", e.Host)
+}
+
+// configFor returns the tls config to dial the upstream host
+func (ut *upstreamTls) configFor(host string) *tls.Config {
+	config := &tls.Config{
+		ServerName: host,
+		RootCAs:    ut.roots,
+		MinVersion: tls.VersionTLS12,
+	}
+	config.InsecureSkipVerify = matchAny(ut.insecure, host)
+
+	for _, cc := range ut.clientCerts {
+		if cc.matcher.Match(host) {
+			config.Certificates = []tls.Certificate{cc.keypair}
+			break
+		}
+	}
+
+	var pins map[string]bool
+	for _, pin := range ut.pins {
+		if pin.matcher.Match(host) {
+			pins = pin.fingerprints
+			break
+		}
+	}
+	if pins != nil {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.Raw)
+				if pins[hex.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return &PinError{Host: host}
+		}
+	}
+	return config
+}
+
+// SetUpstreamTls validates and applies the upstream verification policy
+func (p *ProxyServer) SetUpstreamTls(u *UpstreamTls) error {
+	ut, err := u.build()
+	if err != nil {
+		return err
+	}
+	p.updateSettings(func(s *proxySettings) {
+		s.upstreamTls = ut
+	})
+	return nil
+}
+
+// describeTlsError turns an upstream handshake error into a readable reason
+func describeTlsError(err error) string {
+	var pinErr *PinError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &pinErr):
+		return pinErr.Error()
+	case errors.As(err, &unknownAuthority):
+		return "the certificate is signed by an unknown authority"
+	case errors.As(err, &hostnameErr):
+		return fmt.Sprintf("the certificate is not valid for %v", hostnameErr.Host)
+	case errors.As(err, &invalidErr):
+		return "the certificate is invalid: " + invalidErr.Error()
+	default:
+		return err.Error()
+	}
+}
+
+// isTlsVerifyError tells whether the error comes from the certificate verification
+func isTlsVerifyError(err error) bool {
+	var pinErr *PinError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &pinErr) || errors.As(err, &verifyErr) || errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// writeUpstreamTlsError reports an upstream tls failure to the client as a page
+func writeUpstreamTlsError(w http.ResponseWriter, host string, err error) {
+	title := "Upstream TLS handshake failed"
+	if isTlsVerifyError(err) {
+		title = "Upstream certificate verification failed"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusBadGateway)
+	fmt.Fprintf(w, "<html><head><title>%v</title></head><body><h1>%v</h1><p>The proxy could not establish a trusted connection to <b>%v</b>.</p><p>%v</p></body></html>\n",
+		title, title, html.EscapeString(host), html.EscapeString(describeTlsError(err)))
+}
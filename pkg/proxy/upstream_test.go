@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"xiaolongbaoproxy/pkg/key"
+)
+
+// startTlsUpstream is an https server with a self-signed certificate for
+// 127.0.0.1, it answers "ok"
+func startTlsUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// writeUpstreamCA writes the certificate of the upstream into a PEM bundle
+func writeUpstreamCA(t *testing.T, s *httptest.Server) string {
+	t.Helper()
+	bundle := filepath.Join(newTempDir(t), "upstream.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: key.PEM_HEADER_CERTIFICATE, Bytes: s.Certificate().Raw})
+	if err := ioutil.WriteFile(bundle, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return bundle
+}
+
+func upstreamFingerprint(s *httptest.Server) string {
+	sum := sha256.Sum256(s.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// mitmGet fetches https://target/ through the mitm proxy p, trusting its CA
+func mitmGet(t *testing.T, p *ProxyServer, ca *key.Certificate, target string) (*http.Response, string) {
+	t.Helper()
+	proxySrv := httptest.NewServer(p)
+	t.Cleanup(proxySrv.Close)
+	proxyUrl, _ := url.Parse(proxySrv.URL)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyUrl),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+	res, err := client.Get("https://" + target + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func TestUpstreamTlsVerification(t *testing.T) {
+	upstream := startTlsUpstream(t)
+	target := strings.TrimPrefix(upstream.URL, "https://")
+	fingerprint := upstreamFingerprint(upstream)
+	tests := []struct {
+		name     string
+		upstream func() *UpstreamTls
+		status   int
+		body     string
+	}{
+		{
+			name:     "untrusted by default",
+			upstream: func() *UpstreamTls { return &UpstreamTls{} },
+			status:   http.StatusBadGateway,
+			body:     "Upstream certificate verification failed",
+		},
+		{
+			name: "trusted root",
+			upstream: func() *UpstreamTls {
+				return &UpstreamTls{RootCAs: []string{writeUpstreamCA(t, upstream)}, NoSystemRoots: true}
+			},
+			status: http.StatusOK,
+			body:   "ok",
+		},
+		{
+			name:     "insecure host",
+			upstream: func() *UpstreamTls { return &UpstreamTls{InsecureHosts: []string{"127.0.0.1"}} },
+			status:   http.StatusOK,
+			body:     "ok",
+		},
+		{
+			name: "matching pin",
+			upstream: func() *UpstreamTls {
+				return &UpstreamTls{
+					InsecureHosts: []string{"127.0.0.1"},
+					Pins:          map[string][]string{"127.0.0.1": {strings.ToUpper(fingerprint)}},
+				}
+			},
+			status: http.StatusOK,
+			body:   "ok",
+		},
+		{
+			name: "other pin",
+			upstream: func() *UpstreamTls {
+				return &UpstreamTls{
+					RootCAs: []string{writeUpstreamCA(t, upstream)},
+					Pins:    map[string][]string{"127.0.0.1": {strings.Repeat("ab", sha256.Size)}},
+				}
+			},
+			status: http.StatusBadGateway,
+			body:   "does not match the pinned fingerprints",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ca, _ := newTestMitmServer(t)
+			if err := p.SetUpstreamTls(tt.upstream()); err != nil {
+				t.Fatal(err)
+			}
+			res, body := mitmGet(t, p, ca, target)
+			if res.StatusCode != tt.status || !strings.Contains(body, tt.body) {
+				t.Fatalf("got %v %q, want %v %q", res.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestUpstreamTlsBuildErrors(t *testing.T) {
+	empty := filepath.Join(newTempDir(t), "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no pem here"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		u    *UpstreamTls
+	}{
+		{"missing bundle", &UpstreamTls{RootCAs: []string{filepath.Join(newTempDir(t), "missing.pem")}}},
+		{"empty bundle", &UpstreamTls{RootCAs: []string{empty}}},
+		{"short pin", &UpstreamTls{Pins: map[string][]string{"example.com": {"abcd"}}}},
+		{"not hex pin", &UpstreamTls{Pins: map[string][]string{"example.com": {strings.Repeat("zz", sha256.Size)}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.u.build(); err == nil {
+				t.Fatal("the upstream tls was accepted")
+			}
+		})
+	}
+}
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPattern(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHostPattern(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestWriteUpstreamTlsError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		title string
+	}{
+		{"pin", &PinError{Host: "example.com"}, "Upstream certificate verification failed"},
+		{"unknown authority", x509.UnknownAuthorityError{}, "Upstream certificate verification failed"},
+		{"handshake", errors.New("remote error: tls: handshake failure"), "Upstream TLS handshake failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeUpstreamTlsError(w, "<example.com>", tt.err)
+			body := w.Body.String()
+			if w.Code != http.StatusBadGateway || !strings.Contains(body, "<h1>"+tt.title+"</h1>") {
+				t.Fatalf("got %v %q", w.Code, body)
+			}
+			if !strings.Contains(body, "&lt;example.com&gt;") {
+				t.Fatalf("the host was not escaped: %q", body)
+			}
+		})
+	}
+}